@@ -0,0 +1,49 @@
+package pq
+
+// DescribeColumns is a pgpin addition to the vendored lib/pq,
+// exposing the row descriptions that database/sql can't.
+
+import (
+	"errors"
+
+	"github.com/lib/pq/oid"
+)
+
+// ColumnDescription describes a column of a statement's results, as
+// given in the row description Postgres sends for the statement.
+type ColumnDescription struct {
+	Name string
+	// The object ID of the column's data type.
+	TypeOID oid.Oid
+	// The object ID of the table the column is read directly from,
+	// and the column's attribute number there, or zero if it's not
+	// read directly from a table column.
+	TableOID  oid.Oid
+	TableAttr int
+}
+
+// DescribeColumns describes the columns of the results of query,
+// without running it. driverConn must be a connection of this
+// driver with no rows open, as passed to the function given to
+// database/sql's Conn.Raw.
+func DescribeColumns(driverConn interface{}, query string) (_ []ColumnDescription, err error) {
+	cn, ok := driverConn.(*conn)
+	if !ok {
+		return nil, errors.New("pq: DescribeColumns requires a lib/pq connection")
+	}
+	if err := cn.err.get(); err != nil {
+		return nil, err
+	}
+	defer cn.errRecover(&err)
+	st := cn.prepareTo(query, "")
+	columns := make([]ColumnDescription, len(st.colNames))
+	for i, name := range st.colNames {
+		columns[i] = ColumnDescription{
+			Name:      name,
+			TypeOID:   st.colTyps[i].OID,
+			TableOID:  st.colTyps[i].TableOID,
+			TableAttr: st.colTyps[i].TableAttr,
+		}
+	}
+	return columns, nil
+}
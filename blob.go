@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore is implemented by stores for pin results, which are
+// kept outside the pins table so that listing and scheduling pins
+// doesn't load them. Keys are slash-separated paths of ids.
+type BlobStore interface {
+	// Put stores data under key, replacing any existing blob.
+	Put(ctx context.Context, key string, data []byte) error
+	// Open returns a reader for the blob stored under key, or
+	// ErrBlobNotFound. The reader must be closed.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key, if any.
+	Delete(ctx context.Context, key string) error
+}
+
+// ErrBlobNotFound is returned when opening a blob that doesn't exist.
+var ErrBlobNotFound = errors.New("blob: not found")
+
+// BlobBackend is the store used for pin results, as selected by
+// ConfigBlobBackend.
+var BlobBackend BlobStore
+
+// BlobStart configures BlobBackend according to the environment.
+func BlobStart() {
+	log.Printf("blob.start backend=%s", ConfigBlobBackend)
+	switch ConfigBlobBackend {
+	case "postgres":
+		BlobBackend = BlobNewPg()
+	case "file":
+		BlobBackend = BlobNewFile(ConfigBlobDir)
+	case "s3":
+		store, err := BlobNewS3(ConfigBlobS3Url)
+		Must(err)
+		BlobBackend = store
+	default:
+		panic(fmt.Sprintf("blob: unknown backend %q", ConfigBlobBackend))
+	}
+}
+
+// Postgres.
+
+// BlobPg is a blob store backed by the blobs table. Blobs are read
+// into memory when opened, so readers of large blobs, such as
+// results downloads, hold them whole in memory rather than
+// streaming them.
+type BlobPg struct{}
+
+func BlobNewPg() *BlobPg {
+	return &BlobPg{}
+}
+
+func (s *BlobPg) Put(ctx context.Context, key string, data []byte) error {
+	_, err := PgConn.ExecContext(ctx, "INSERT INTO blobs (key, data, created_at) VALUES ($1, $2, now()) ON CONFLICT (key) DO UPDATE SET data=EXCLUDED.data", key, data)
+	return err
+}
+
+func (s *BlobPg) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	var data []byte
+	err := PgConn.QueryRowContext(ctx, "SELECT data FROM blobs WHERE key=$1", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *BlobPg) Delete(ctx context.Context, key string) error {
+	_, err := PgConn.ExecContext(ctx, "DELETE FROM blobs WHERE key=$1", key)
+	return err
+}
+
+// Filesystem.
+
+// BlobFile is a blob store keeping each blob in a file under Dir.
+// Blobs are written to a temporary file and renamed into place, so
+// that readers never see partial blobs.
+type BlobFile struct {
+	Dir string
+}
+
+func BlobNewFile(dir string) *BlobFile {
+	return &BlobFile{Dir: dir}
+}
+
+func (s *BlobFile) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("blob: invalid key %q", key)
+		}
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func (s *BlobFile) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".blob-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err != nil {
+		Must(tmp.Close())
+		Must(os.Remove(tmp.Name()))
+		return err
+	}
+	err = tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		Must(os.Remove(tmp.Name()))
+	}
+	return err
+}
+
+func (s *BlobFile) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *BlobFile) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3.
+
+// BlobS3 is a blob store backed by a bucket of an S3-compatible
+// object store, addressed path-style and authenticated with AWS
+// Signature Version 4. Puts and deletes time out after
+// ConfigBlobTimeout. Opens only wait that long for the response
+// headers, so that blobs can be streamed for as long as the
+// caller's context allows.
+type BlobS3 struct {
+	Endpoint        *url.URL
+	Bucket          string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+// BlobNewS3 returns a store for the bucket given by rawUrl, of the
+// form https://<access key id>:<secret access key>@<host>/<bucket>?region=<region>.
+// The region defaults to us-east-1.
+func BlobNewS3(rawUrl string) (*BlobS3, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	bucket := strings.Trim(u.Path, "/")
+	if u.User == nil || bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("blob: invalid s3 url")
+	}
+	secretAccessKey, _ := u.User.Password()
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = ConfigBlobTimeout
+	return &BlobS3{
+		Endpoint:        &url.URL{Scheme: u.Scheme, Host: u.Host},
+		Bucket:          bucket,
+		Region:          region,
+		AccessKeyId:     u.User.Username(),
+		SecretAccessKey: secretAccessKey,
+		Client:          &http.Client{Transport: transport},
+	}, nil
+}
+
+func (s *BlobS3) Put(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, ConfigBlobTimeout)
+	defer cancel()
+	res, err := s.do(ctx, "PUT", key, data)
+	if err != nil {
+		return err
+	}
+	defer func() { Must(res.Body.Close()) }()
+	if res.StatusCode != 200 {
+		return s.error("PUT", key, res)
+	}
+	return nil
+}
+
+func (s *BlobS3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 200 {
+		return res.Body, nil
+	}
+	defer func() { Must(res.Body.Close()) }()
+	if res.StatusCode == 404 {
+		return nil, ErrBlobNotFound
+	}
+	return nil, s.error("GET", key, res)
+}
+
+func (s *BlobS3) Delete(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, ConfigBlobTimeout)
+	defer cancel()
+	res, err := s.do(ctx, "DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { Must(res.Body.Close()) }()
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return s.error("DELETE", key, res)
+	}
+	return nil
+}
+
+func (s *BlobS3) do(ctx context.Context, method string, key string, data []byte) (*http.Response, error) {
+	u := *s.Endpoint
+	u.Path = "/" + s.Bucket + "/" + key
+	u.RawPath = blobS3Escape(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, data, time.Now().UTC())
+	return s.Client.Do(req)
+}
+
+func (s *BlobS3) error(method string, key string, res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("blob: s3 %s %s: %s %s", method, key, res.Status, body)
+}
+
+// sign adds AWS Signature Version 4 headers to req, signing the
+// host, payload hash and date headers.
+func (s *BlobS3) sign(req *http.Request, data []byte, now time.Time) {
+	payloadHash := blobS3Hash(data)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + blobS3Hash([]byte(canonicalRequest))
+	signingKey := blobS3Hmac([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = blobS3Hmac(signingKey, s.Region)
+	signingKey = blobS3Hmac(signingKey, "s3")
+	signingKey = blobS3Hmac(signingKey, "aws4_request")
+	signature := hex.EncodeToString(blobS3Hmac(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func blobS3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func blobS3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// blobS3Escape escapes path as required by Signature Version 4,
+// leaving only unreserved characters and slashes unescaped.
+func blobS3Escape(path string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
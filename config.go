@@ -7,21 +7,49 @@ import (
 )
 
 var (
+	ConfigBlobBackend              = env.StringDefault("BLOB_BACKEND", "postgres")
+	ConfigBlobDir                  = env.StringDefault("BLOB_DIR", "")
+	ConfigBlobS3Url                = env.StringDefault("BLOB_S3_URL", "")
+	ConfigBlobTimeout              = 30 * time.Second
 	ConfigDatabaseConnectTimeout   = 5 * time.Second
 	ConfigDatabaseStatementTimeout = 5 * time.Second
 	ConfigDatabasePoolSize         = 5
 	ConfigDatabaseUrl              = env.String("DATABASE_URL")
+	ConfigDbMaxQueries             = 2
+	ConfigDbMaxQueriesMax          = 50
+	ConfigDbPoolIdleTimeout        = 5 * time.Minute
+	ConfigDbSaturatedDelay         = 5 * time.Second
 	ConfigFernetKeys               = fernet.MustDecodeKeys(env.String("FERNET_KEYS"))
 	ConfigFernetTtl                = time.Hour * 24 * 365 * 10
+	ConfigPinLeaseTtl              = 2 * time.Minute
 	ConfigPinRefreshInterval       = 20 * time.Minute
+	ConfigPinResultsBytesMax       = env.IntDefault("PIN_RESULTS_BYTES_MAX", 10*1024*1024)
 	ConfigPinResultsRowsMax        = 10000
 	ConfigPinStatementTimeout      = 30 * time.Second
+	ConfigQueueBackend             = env.StringDefault("QUEUE_BACKEND", "redis")
+	ConfigQueueLockTtl             = 5 * time.Minute
+	ConfigQueuePollInterval        = 1 * time.Second
 	ConfigRedisPoolSize            = 5
-	ConfigRedisUrl                 = env.String("REDIS_URL")
+	ConfigRedisUrl                 = env.StringDefault("REDIS_URL", "")
+	ConfigReportFile               = env.StringDefault("REPORT_FILE", "")
+	ConfigReportQueueSize          = 100
+	ConfigReportSentryDsn          = env.StringDefault("SENTRY_DSN", "")
+	ConfigReportTimeout            = 5 * time.Second
+	ConfigSchedulerBatchSize       = 500
+	ConfigSchedulerLeaseTtl        = 30 * time.Second
 	ConfigSchedulerTickInterval    = 10 * time.Second
+	ConfigStatusPinOverdueMax      = 10 * time.Minute
+	ConfigStatusQueueDepthMax      = 1000
+	ConfigStatusSchedulerTickMax   = 1 * time.Minute
 	ConfigTestLogs                 = env.StringDefault("TEST_LOGS", "false") != "true"
 	ConfigWebPort                  = env.IntDefault("PORT", 5000)
+	ConfigWebStreamTimeout         = 5 * time.Minute
 	ConfigWebTimeout               = time.Second * 5
 	ConfigWebDrainInterval         = time.Second * 10
+	ConfigWorkerHeartbeatInterval  = 5 * time.Second
+	ConfigWorkerHeartbeatTtl       = 30 * time.Second
 	ConfigWorkerPoolSize           = 5
+	ConfigWorkerRetryBackoff       = 15 * time.Second
+	ConfigWorkerRetryBackoffMax    = 5 * time.Minute
+	ConfigWorkerRetryMax           = 5
 )
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+)
+
+type contextKey int
+
+const (
+	contextKeyRequestId contextKey = iota
+)
+
+// ContextWithRequestId returns a copy of ctx carrying the given
+// request id, so that it can be included in logs and job payloads
+// below the HTTP layer.
+func ContextWithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestId, requestId)
+}
+
+// ContextRequestId returns the request id carried by ctx, or the
+// empty string if there isn't one.
+func ContextRequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(contextKeyRequestId).(string)
+	return requestId
+}
+
+// ContextShutdown returns a context that is cancelled when the
+// process is asked to shut down, so that work in flight, including
+// queries against Postgres, can be abandoned promptly.
+func ContextShutdown() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	return ctx
+}
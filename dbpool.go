@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Worker-side connection pools for pin dbs. A pool is kept per db,
+// keyed by the db's id and URL, so that a changed URL gets a fresh
+// pool: db updates happen in the web process, so the worker only
+// sees them through the URL it reads with each pin. Pools allow at
+// most the db's MaxQueries open connections, and are closed once
+// unused for ConfigDbPoolIdleTimeout.
+
+type dbPoolKey struct {
+	DbId string
+	Url  string
+}
+
+type dbPoolEntry struct {
+	Pool   *sql.DB
+	UsedAt time.Time
+}
+
+var (
+	dbPoolMutex   sync.Mutex
+	dbPoolEntries = map[dbPoolKey]*dbPoolEntry{}
+	dbPoolClosing sync.WaitGroup
+)
+
+// DbPoolGet returns the connection pool for db, opening it if
+// needed. Pools for the same db but a different URL are closed.
+func DbPoolGet(db *Db) (*sql.DB, error) {
+	dbPoolMutex.Lock()
+	defer dbPoolMutex.Unlock()
+	key := dbPoolKey{DbId: db.Id, Url: db.Url}
+	entry, ok := dbPoolEntries[key]
+	if !ok {
+		for otherKey := range dbPoolEntries {
+			if otherKey.DbId == db.Id {
+				dbPoolClose(otherKey, "url-changed")
+			}
+		}
+		pool, err := sql.Open("postgres", fmt.Sprintf("%s?statement_timeout=%d&connect_timeout=%d&intervalstyle=iso_8601",
+			db.Url, ConfigPinStatementTimeout/time.Millisecond, ConfigDatabaseConnectTimeout/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		pool.SetConnMaxIdleTime(ConfigDbPoolIdleTimeout)
+		entry = &dbPoolEntry{Pool: pool}
+		dbPoolEntries[key] = entry
+		log.Printf("dbpool.open db_id=%s", db.Id)
+	}
+	entry.Pool.SetMaxOpenConns(db.MaxQueries)
+	entry.Pool.SetMaxIdleConns(db.MaxQueries)
+	entry.UsedAt = time.Now()
+	return entry.Pool, nil
+}
+
+// DbPoolInvalidate closes any pool for the db with the given id, as
+// when the worker finds the db deleted.
+func DbPoolInvalidate(dbId string) {
+	dbPoolMutex.Lock()
+	defer dbPoolMutex.Unlock()
+	for key := range dbPoolEntries {
+		if key.DbId == dbId {
+			dbPoolClose(key, "invalidated")
+		}
+	}
+}
+
+// DbPoolEvict closes pools unused for ConfigDbPoolIdleTimeout.
+func DbPoolEvict() {
+	dbPoolMutex.Lock()
+	defer dbPoolMutex.Unlock()
+	for key, entry := range dbPoolEntries {
+		if time.Since(entry.UsedAt) > ConfigDbPoolIdleTimeout {
+			dbPoolClose(key, "idle")
+		}
+	}
+}
+
+// DbPoolCloseAll closes all pools, waiting for the closes to finish.
+func DbPoolCloseAll() {
+	dbPoolMutex.Lock()
+	for key := range dbPoolEntries {
+		dbPoolClose(key, "shutdown")
+	}
+	dbPoolMutex.Unlock()
+	dbPoolClosing.Wait()
+}
+
+// DbPoolSize returns the number of open pools.
+func DbPoolSize() int {
+	dbPoolMutex.Lock()
+	defer dbPoolMutex.Unlock()
+	return len(dbPoolEntries)
+}
+
+// dbPoolClose forgets the pool with the given key and closes it in
+// the background. It must be called with dbPoolMutex held. Closing
+// waits for queries in flight on the pool to finish, so it's done
+// without the mutex to not block other pools meanwhile.
+func dbPoolClose(key dbPoolKey, reason string) {
+	pool := dbPoolEntries[key].Pool
+	delete(dbPoolEntries, key)
+	log.Printf("dbpool.close db_id=%s reason=%s", key.DbId, reason)
+	dbPoolClosing.Add(1)
+	go func() {
+		defer dbPoolClosing.Done()
+		err := pool.Close()
+		if err != nil {
+			log.Printf("dbpool.error db_id=%s %s", key.DbId, err)
+		}
+	}()
+}
+
+// DbPoolStart evicts idle pools periodically until ctx is done,
+// and then closes all pools.
+func DbPoolStart(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				DbPoolCloseAll()
+				return
+			case <-time.After(ConfigDbPoolIdleTimeout / 2):
+				DbPoolEvict()
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDbPoolReused(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pool1, err := DbPoolGet(dbIn)
+	Must(err)
+	pool2, err := DbPoolGet(dbIn)
+	Must(err)
+	assert.True(t, pool1 == pool2)
+	assert.Equal(t, 1, DbPoolSize())
+	assert.Equal(t, ConfigDbMaxQueries, pool1.Stats().MaxOpenConnections)
+}
+
+func TestDbPoolUrlChanged(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pool1, err := DbPoolGet(dbIn)
+	Must(err)
+	dbIn.Url = ConfigDatabaseUrl + "-moar"
+	pool2, err := DbPoolGet(dbIn)
+	Must(err)
+	assert.False(t, pool1 == pool2)
+	assert.Equal(t, 1, DbPoolSize())
+}
+
+func TestDbPoolEvictIdle(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	_, err := DbPoolGet(dbIn)
+	Must(err)
+	DbPoolEvict()
+	assert.Equal(t, 1, DbPoolSize())
+	ConfigDbPoolIdleTimeoutPrev := ConfigDbPoolIdleTimeout
+	defer func() { ConfigDbPoolIdleTimeout = ConfigDbPoolIdleTimeoutPrev }()
+	ConfigDbPoolIdleTimeout = time.Nanosecond
+	DbPoolEvict()
+	assert.Equal(t, 0, DbPoolSize())
+}
+
+func TestDbPoolApplicationName(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select current_setting('application_name')")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Nil(t, pinOut.ResultsError)
+	assert.Contains(t, string(pinOut.ResultsRows), "pgpin.pin."+pinIn.Id)
+}
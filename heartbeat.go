@@ -0,0 +1,159 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Heartbeat describes a live worker process and the jobs it's
+// running. Each worker process periodically records its heartbeat
+// in Postgres, and heartbeats that haven't been refreshed within
+// ConfigWorkerHeartbeatTtl are considered stale.
+type Heartbeat struct {
+	Id          string          `json:"id"`
+	Hostname    string          `json:"hostname"`
+	Pid         int             `json:"pid"`
+	StartedAt   time.Time       `json:"started_at"`
+	HeartbeatAt time.Time       `json:"heartbeat_at"`
+	Jobs        []*HeartbeatJob `json:"jobs"`
+}
+
+type HeartbeatJob struct {
+	JobId     string    `json:"job_id"`
+	PinId     string    `json:"pin_id"`
+	RequestId string    `json:"request_id"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+var (
+	heartbeatMutex sync.Mutex
+	heartbeatSelf  *Heartbeat
+	heartbeatJobs  = map[string]*HeartbeatJob{}
+)
+
+// HeartbeatJobStart records that the current process has started
+// running the given job.
+func HeartbeatJobStart(jobId string, pinId string, requestId string) {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	heartbeatJobs[jobId] = &HeartbeatJob{
+		JobId:     jobId,
+		PinId:     pinId,
+		RequestId: requestId,
+		StartedAt: time.Now(),
+	}
+}
+
+// HeartbeatJobFinish records that the current process is no longer
+// running the given job.
+func HeartbeatJobFinish(jobId string) {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	delete(heartbeatJobs, jobId)
+}
+
+func heartbeatSnapshot() *Heartbeat {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	heartbeat := *heartbeatSelf
+	heartbeat.HeartbeatAt = time.Now()
+	heartbeat.Jobs = []*HeartbeatJob{}
+	for _, job := range heartbeatJobs {
+		heartbeat.Jobs = append(heartbeat.Jobs, job)
+	}
+	sort.Slice(heartbeat.Jobs, func(i, j int) bool {
+		return heartbeat.Jobs[i].StartedAt.Before(heartbeat.Jobs[j].StartedAt)
+	})
+	return &heartbeat
+}
+
+// HeartbeatBeat records the current process's heartbeat and clears
+// out stale heartbeats of other processes.
+func HeartbeatBeat(ctx context.Context) error {
+	heartbeat := heartbeatSnapshot()
+	_, err := PgConn.ExecContext(ctx, "INSERT INTO workers (id, hostname, pid, started_at, heartbeat_at, jobs) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO UPDATE SET heartbeat_at=EXCLUDED.heartbeat_at, jobs=EXCLUDED.jobs",
+		heartbeat.Id, heartbeat.Hostname, heartbeat.Pid, heartbeat.StartedAt, heartbeat.HeartbeatAt, MustNewPgJson(heartbeat.Jobs))
+	if err != nil {
+		return err
+	}
+	_, err = PgConn.ExecContext(ctx, "DELETE FROM workers WHERE heartbeat_at < $1", time.Now().Add(-ConfigWorkerHeartbeatTtl))
+	return err
+}
+
+// HeartbeatStart records an initial heartbeat for the current
+// process and continues to do so every ConfigWorkerHeartbeatInterval
+// until ctx is done, at which point the process's heartbeat is
+// removed.
+func HeartbeatStart(ctx context.Context) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	id := uuid.New()
+	heartbeatMutex.Lock()
+	heartbeatSelf = &Heartbeat{
+		Id:        id,
+		Hostname:  hostname,
+		Pid:       os.Getpid(),
+		StartedAt: time.Now(),
+	}
+	heartbeatMutex.Unlock()
+	log.Printf("heartbeat.start worker_id=%s", id)
+	err = HeartbeatBeat(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				_, err := PgConn.Exec("DELETE FROM workers WHERE id=$1", id)
+				if err != nil {
+					log.Printf("heartbeat.error worker_id=%s %s", id, err)
+				}
+				return
+			case <-time.After(ConfigWorkerHeartbeatInterval):
+				err := HeartbeatBeat(ctx)
+				if err != nil {
+					log.Printf("heartbeat.error worker_id=%s %s", id, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// HeartbeatList returns the heartbeats of all live worker processes.
+func HeartbeatList(ctx context.Context) ([]*Heartbeat, error) {
+	res, err := PgConn.QueryContext(ctx, "SELECT id, hostname, pid, started_at, heartbeat_at, jobs FROM workers WHERE heartbeat_at >= $1 ORDER BY started_at",
+		time.Now().Add(-ConfigWorkerHeartbeatTtl))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { Must(res.Close()) }()
+	heartbeats := []*Heartbeat{}
+	for res.Next() {
+		heartbeat := Heartbeat{}
+		jobs := PgJson{}
+		err := res.Scan(&heartbeat.Id, &heartbeat.Hostname, &heartbeat.Pid, &heartbeat.StartedAt, &heartbeat.HeartbeatAt, &jobs)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(jobs, &heartbeat.Jobs)
+		if err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, &heartbeat)
+	}
+	err = res.Err()
+	if err != nil {
+		return nil, err
+	}
+	return heartbeats, nil
+}
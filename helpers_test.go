@@ -2,15 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/darkhelmet/env"
-	"github.com/jrallison/go-workers"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"time"
 )
 
 // Setup and teardown.
@@ -20,22 +19,37 @@ func init() {
 		log.SetOutput(ioutil.Discard)
 	}
 	ConfigDatabaseUrl = env.String("TEST_DATABASE_URL")
-	ConfigRedisUrl = env.String("TEST_REDIS_URL")
+	ConfigQueueBackend = "memory"
 	WebBuild()
 	PgStart()
-	RedisStart()
+	QueueBackend = testQueue
+	BlobBackend = BlobNewPg()
 	clear()
 }
 
+// testQueue holds the jobs enqueued by tests, which are run one at
+// a time with mustWorkerTick.
+var testQueue = QueueNewMemory()
+
 func clear() {
-	_, err := PgConn.Exec("DELETE from pins")
+	_, err := PgConn.Exec("DELETE from scheduler_outbox")
+	Must(err)
+	_, err = PgConn.Exec("DELETE from pins")
 	Must(err)
 	_, err = PgConn.Exec("DELETE from dbs")
 	Must(err)
-	conn := workers.Config.Pool.Get()
-	_, err = conn.Do("flushdb")
-	defer conn.Close()
+	_, err = PgConn.Exec("DELETE from workers")
+	Must(err)
+	_, err = PgConn.Exec("DELETE from dead_jobs")
+	Must(err)
+	_, err = PgConn.Exec("DELETE from leases")
 	Must(err)
+	_, err = PgConn.Exec("DELETE from jobs")
+	Must(err)
+	_, err = PgConn.Exec("DELETE from blobs")
+	Must(err)
+	testQueue.Clear()
+	DbPoolCloseAll()
 }
 
 // Helpers.
@@ -52,45 +66,47 @@ func mustRequest(method, url string, body io.Reader) *httptest.ResponseRecorder
 	return res
 }
 
+func mustRequestHeader(method, url string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, body)
+	Must(err)
+	req.Header = header
+	res := httptest.NewRecorder()
+	WebMux.ServeHTTP(res, req)
+	return res
+}
+
 func mustDecode(res *httptest.ResponseRecorder, data interface{}) {
 	Must(json.NewDecoder(res.Body).Decode(data))
 }
 
 func mustDbCreate(name string, url string) *Db {
-	db, err := DbCreate(name, url)
+	db, err := DbCreate(context.Background(), name, url, ConfigDbMaxQueries)
 	Must(err)
 	return db
 }
 
 func mustPinCreate(dbId string, name string, query string) *Pin {
-	pin, err := PinCreate(dbId, name, query)
+	pin, err := PinCreate(context.Background(), dbId, name, query, ConfigPinResultsRowsMax)
 	Must(err)
 	return pin
 }
 
 func mustPinGet(id string) *Pin {
-	pin, err := PinGet(id)
+	pin, err := PinGet(context.Background(), id)
 	Must(err)
+	Must(PinLoadResults(context.Background(), pin))
 	return pin
 }
 
 func mustWorkerTick() {
-	var message *workers.Msg
-	fetcher := workers.NewFetch("queue:pins", make(chan *workers.Msg))
-	go fetcher.Fetch()
-	defer fetcher.Close()
-	select {
-	case message = <-fetcher.Messages():
-	case <-time.After(10 * time.Millisecond):
-	}
-	if message != nil {
-		WorkerProcessWrapper(message)
-		fetcher.Acknowledge(message)
+	job := testQueue.Take(WorkerQueues...)
+	if job != nil {
+		WorkerProcessWrapper(context.Background(), job)
 	}
 }
 
 func mustSchedulerTick() {
-	Must(SchedulerTick())
+	Must(SchedulerTick(context.Background()))
 }
 
 func mustCanonicalizeJson(in []byte) string {
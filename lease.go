@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Leases are named, time-limited locks stored in Postgres, used to
+// coordinate work across processes. A lease is held by at most one
+// holder at a time, and becomes free when released or when it
+// expires. Expiry is judged by the Postgres clock so that clock
+// skew between processes doesn't matter.
+
+// LeaseAcquire attempts to take the named lease for holder for the
+// given ttl. It succeeds if the lease is free, expired, or already
+// held by holder, in which case the lease is extended.
+func LeaseAcquire(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	result, err := PgConn.ExecContext(ctx, "INSERT INTO leases (name, holder, expires_at) VALUES ($1, $2, now() + $3::float8 * interval '1 millisecond') ON CONFLICT (name) DO UPDATE SET holder=EXCLUDED.holder, expires_at=EXCLUDED.expires_at WHERE leases.holder=EXCLUDED.holder OR leases.expires_at < now()",
+		name, holder, ttl/time.Millisecond)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// LeaseRelease frees the named lease if it's held by holder.
+func LeaseRelease(ctx context.Context, name string, holder string) error {
+	_, err := PgConn.ExecContext(ctx, "DELETE FROM leases WHERE name=$1 AND holder=$2", name, holder)
+	return err
+}
+
+// LeaseKeep renews the named lease, already held by holder, every
+// third of ttl until the returned stop function is called, so that
+// it's kept for work that may outlast ttl. If a renewal finds the
+// lease taken by another holder, as after it expired while renewals
+// were failing, the returned context is cancelled so that the work
+// stops.
+func LeaseKeep(ctx context.Context, name string, holder string, ttl time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			leased, err := LeaseAcquire(ctx, name, holder, ttl)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("lease.error name=%s holder=%s %s", name, holder, err)
+				}
+				continue
+			}
+			if !leased {
+				log.Printf("lease.lost name=%s holder=%s", name, holder)
+				cancel()
+				return
+			}
+		}
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	return ctx, stop
+}
@@ -30,4 +30,5 @@ func main() {
 	default:
 		usage()
 	}
+	ReportFlush()
 }
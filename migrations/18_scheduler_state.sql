@@ -0,0 +1,9 @@
+BEGIN;
+
+CREATE TABLE scheduler_state (
+    ticked_at timestamptz
+);
+
+INSERT INTO scheduler_state (ticked_at) VALUES (NULL);
+
+COMMIT;
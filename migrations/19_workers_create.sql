@@ -0,0 +1,8 @@
+CREATE TABLE workers (
+    id           uuid PRIMARY KEY,
+    hostname     text NOT NULL,
+    pid          int NOT NULL,
+    started_at   timestamptz NOT NULL,
+    heartbeat_at timestamptz NOT NULL,
+    jobs         json NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE pins
+ADD COLUMN query_attempts int NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+CREATE TABLE dead_jobs (
+    id          uuid PRIMARY KEY,
+    job_id      text NOT NULL,
+    pin_id      text NOT NULL,
+    request_id  text NOT NULL,
+    attempts    int NOT NULL,
+    error       text NOT NULL,
+    stack       text,
+    created_at  timestamptz NOT NULL,
+    replayed_at timestamptz
+);
@@ -0,0 +1,11 @@
+CREATE TABLE jobs (
+    id           uuid PRIMARY KEY,
+    queue        text NOT NULL,
+    payload      json NOT NULL,
+    run_at       timestamptz NOT NULL,
+    locked_by    text,
+    locked_until timestamptz,
+    created_at   timestamptz NOT NULL
+);
+
+CREATE INDEX jobs_queue_run_at ON jobs (queue, run_at);
@@ -0,0 +1,2 @@
+ALTER TABLE dbs
+ADD COLUMN max_queries int NOT NULL DEFAULT 2;
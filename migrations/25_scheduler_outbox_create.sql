@@ -0,0 +1,5 @@
+CREATE TABLE scheduler_outbox (
+    pin_id     uuid PRIMARY KEY REFERENCES pins (id),
+    request_id text NOT NULL,
+    created_at timestamptz NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE pins
+ADD COLUMN results_sets json;
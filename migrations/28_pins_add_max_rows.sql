@@ -0,0 +1,4 @@
+ALTER TABLE pins
+ADD COLUMN max_rows int NOT NULL DEFAULT 10000,
+ADD COLUMN results_truncated boolean NOT NULL DEFAULT false,
+ADD COLUMN results_row_count int;
@@ -0,0 +1,2 @@
+ALTER TABLE pins
+ADD COLUMN results_size int NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+CREATE TABLE blobs (
+    key        text PRIMARY KEY,
+    data       bytea NOT NULL,
+    created_at timestamptz NOT NULL
+);
@@ -0,0 +1,6 @@
+-- Results are now stored as blobs. results_rows and results_sets are
+-- kept for pins last run before then, whose results are read from
+-- them until the pins are next run, and are to be dropped once no
+-- pin has them.
+ALTER TABLE pins
+ADD COLUMN results_key text;
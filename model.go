@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"database/sql"
-	"github.com/jrallison/go-workers"
+	"encoding/json"
 	_ "github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"log"
 	"regexp"
 	"time"
 )
@@ -15,36 +20,92 @@ var DataUuidRegexp = regexp.MustCompilePOSIX("[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4
 
 // Structs.
 
+// Pin results are held in BlobBackend under ResultsKey rather than
+// in the pins table, and ResultsRows and ResultsSets are only set
+// once loaded with PinLoadResults. Pins last run before results were
+// moved to blobs have no ResultsKey, and their results are read from
+// the legacy results_rows and results_sets columns until they're
+// next run. Results holds the result sets of
+// a new run, which PinUpdate stores.
 type Pin struct {
-	Id              string     `json:"id"`
-	Name            string     `json:"name"`
-	DbId            string     `json:"db_id"`
-	Query           string     `json:"query"`
-	CreatedAt       time.Time  `json:"created_at"`
-	UpdatedAt       time.Time  `json:"updated_at"`
-	QueryStartedAt  *time.Time `json:"query_started_at"`
-	QueryFinishedAt *time.Time `json:"query_finished_at"`
-	ResultsFields   PgJson     `json:"results_fields"`
-	ResultsRows     PgJson     `json:"results_rows"`
-	ResultsError    *string    `json:"results_error"`
-	ScheduledAt     time.Time  `json:"-"`
-	DeletedAt       *time.Time `json:"-"`
-	Version         int        `json:"-"`
+	Id               string           `json:"id"`
+	Name             string           `json:"name"`
+	DbId             string           `json:"db_id"`
+	Query            string           `json:"query"`
+	MaxRows          int              `json:"max_rows"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+	QueryStartedAt   *time.Time       `json:"query_started_at"`
+	QueryFinishedAt  *time.Time       `json:"query_finished_at"`
+	QueryAttempts    int              `json:"query_attempts"`
+	ResultsFields    PgJson           `json:"results_fields"`
+	ResultsColumns   PgJson           `json:"results_columns"`
+	ResultsRows      PgJson           `json:"results_rows,omitempty"`
+	ResultsTruncated bool             `json:"results_truncated"`
+	ResultsRowCount  *int             `json:"results_row_count"`
+	ResultsSize      int              `json:"results_size"`
+	ResultsError     *string          `json:"results_error"`
+	ResultsSets      PgJson           `json:"results_sets,omitempty"`
+	ResultsKey       *string          `json:"-"`
+	Results          []*PinResultsSet `json:"-"`
+	ScheduledAt      time.Time        `json:"-"`
+	DeletedAt        *time.Time       `json:"-"`
+	Version          int              `json:"-"`
+}
+
+// PinResultsColumn describes a column of pin results. Nullable,
+// Length, Precision and Scale are nil where unknown or unbounded.
+type PinResultsColumn struct {
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Oid       *uint32 `json:"oid"`
+	Nullable  *bool   `json:"nullable"`
+	Length    *int64  `json:"length"`
+	Precision *int64  `json:"precision"`
+	Scale     *int64  `json:"scale"`
+}
+
+// PinResultsSet holds the results of one statement of a pin's
+// query. Fields, Columns and Rows are nil if the statement failed.
+// Statements returning more than the pin's MaxRows rows, or more
+// than fit in what remains of the run's byte budget, have their
+// rows truncated, with Truncated set and RowCount giving the number
+// of rows read before stopping.
+type PinResultsSet struct {
+	Fields    []string            `json:"fields"`
+	Columns   []*PinResultsColumn `json:"columns"`
+	Rows      [][]interface{}     `json:"rows"`
+	Truncated bool                `json:"truncated"`
+	RowCount  int                 `json:"row_count"`
+	Error     *string             `json:"error"`
 }
 
 type Db struct {
-	Id        string     `json:"id"`
-	Name      string     `json:"name"`
-	Url       string     `json:"url"`
-	AddedAt   time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	RemovedAt *time.Time `json:"-"`
-	Version   int        `json:"-"`
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Url        string     `json:"url"`
+	MaxQueries int        `json:"max_queries"`
+	AddedAt    time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	RemovedAt  *time.Time `json:"-"`
+	Version    int        `json:"-"`
+}
+
+type DeadJob struct {
+	Id         string     `json:"id"`
+	JobId      string     `json:"job_id"`
+	PinId      string     `json:"pin_id"`
+	RequestId  string     `json:"request_id"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error"`
+	Stack      *string    `json:"stack"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReplayedAt *time.Time `json:"replayed_at"`
 }
 
 // Db operations.
 
-func DbValidate(db *Db) error {
+func DbValidate(ctx context.Context, db *Db) error {
 	err := ValidateSlug("name", db.Name)
 	if err != nil {
 		return err
@@ -53,7 +114,11 @@ func DbValidate(db *Db) error {
 	if err != nil {
 		return err
 	}
-	sameNamed, err := PgCount("SELECT count(*) FROM dbs WHERE name=$1 and id!=$2 and deleted_at IS NULL", db.Name, db.Id)
+	err = ValidateRange("max_queries", db.MaxQueries, 1, ConfigDbMaxQueriesMax)
+	if err != nil {
+		return err
+	}
+	sameNamed, err := PgCount(ctx, "SELECT count(*) FROM dbs WHERE name=$1 and id!=$2 and deleted_at IS NULL", db.Name, db.Id)
 	if err != nil {
 		return err
 	}
@@ -67,11 +132,11 @@ func DbValidate(db *Db) error {
 	return nil
 }
 
-func DbList(queryFrag string) ([]*Db, error) {
+func DbList(ctx context.Context, queryFrag string) ([]*Db, error) {
 	if queryFrag == "" {
 		queryFrag = "true"
 	}
-	res, err := PgConn.Query("SELECT id, name, url_encrypted, created_at, updated_at, version, deleted_at FROM dbs WHERE deleted_at IS NULL AND " + queryFrag)
+	res, err := PgConn.QueryContext(ctx, "SELECT id, name, url_encrypted, max_queries, created_at, updated_at, version, deleted_at FROM dbs WHERE deleted_at IS NULL AND "+queryFrag)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +145,7 @@ func DbList(queryFrag string) ([]*Db, error) {
 	for res.Next() {
 		db := Db{}
 		urlEncrypted := make([]byte, 0)
-		err := res.Scan(&db.Id, &db.Name, &urlEncrypted, &db.AddedAt, &db.UpdatedAt, &db.Version, &db.RemovedAt)
+		err := res.Scan(&db.Id, &db.Name, &urlEncrypted, &db.MaxQueries, &db.AddedAt, &db.UpdatedAt, &db.Version, &db.RemovedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -94,36 +159,40 @@ func DbList(queryFrag string) ([]*Db, error) {
 	return dbs, nil
 }
 
-func DbCreate(name string, url string) (*Db, error) {
+func DbCreate(ctx context.Context, name string, url string, maxQueries int) (*Db, error) {
 	db := &Db{
-		Id:        uuid.New(),
-		Name:      name,
-		Url:       url,
-		AddedAt:   time.Now(),
-		UpdatedAt: time.Now(),
-		RemovedAt: nil,
-		Version:   1,
-	}
-	err := DbValidate(db)
+		Id:         uuid.New(),
+		Name:       name,
+		Url:        url,
+		MaxQueries: maxQueries,
+		AddedAt:    time.Now(),
+		UpdatedAt:  time.Now(),
+		RemovedAt:  nil,
+		Version:    1,
+	}
+	err := DbValidate(ctx, db)
 	if err == nil {
-		_, err = PgConn.Exec("INSERT INTO dbs (id, name, url_encrypted, created_at, updated_at, deleted_at, version) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-			db.Id, db.Name, FernetEncrypt(db.Url), db.AddedAt, db.UpdatedAt, db.RemovedAt, db.Version)
+		_, err = PgConn.ExecContext(ctx, "INSERT INTO dbs (id, name, url_encrypted, max_queries, created_at, updated_at, deleted_at, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			db.Id, db.Name, FernetEncrypt(db.Url), db.MaxQueries, db.AddedAt, db.UpdatedAt, db.RemovedAt, db.Version)
+	}
+	if err == nil {
+		log.Printf("db.create request_id=%s db_id=%s", ContextRequestId(ctx), db.Id)
 	}
 	return db, err
 }
 
-func DbGet(idOrName string) (*Db, error) {
+func DbGet(ctx context.Context, idOrName string) (*Db, error) {
 	var row *sql.Row
 	if DataUuidRegexp.MatchString(idOrName) {
-		query := "SELECT id, name, url_encrypted, created_at, updated_at, version FROM dbs WHERE deleted_at is NULL AND (id=$1 OR name=$2) LIMIT 1"
-		row = PgConn.QueryRow(query, idOrName, idOrName)
+		query := "SELECT id, name, url_encrypted, max_queries, created_at, updated_at, version FROM dbs WHERE deleted_at is NULL AND (id=$1 OR name=$2) LIMIT 1"
+		row = PgConn.QueryRowContext(ctx, query, idOrName, idOrName)
 	} else {
-		query := "SELECT id, name, url_encrypted, created_at, updated_at, version FROM dbs WHERE deleted_at is NULL AND name=$1 LIMIT 1"
-		row = PgConn.QueryRow(query, idOrName)
+		query := "SELECT id, name, url_encrypted, max_queries, created_at, updated_at, version FROM dbs WHERE deleted_at is NULL AND name=$1 LIMIT 1"
+		row = PgConn.QueryRowContext(ctx, query, idOrName)
 	}
 	db := Db{}
 	urlEncrypted := make([]byte, 0)
-	err := row.Scan(&db.Id, &db.Name, &urlEncrypted, &db.AddedAt, &db.UpdatedAt, &db.Version)
+	err := row.Scan(&db.Id, &db.Name, &urlEncrypted, &db.MaxQueries, &db.AddedAt, &db.UpdatedAt, &db.Version)
 	switch {
 	case err == nil:
 		db.Url = FernetDecrypt(urlEncrypted)
@@ -139,14 +208,14 @@ func DbGet(idOrName string) (*Db, error) {
 	}
 }
 
-func DbUpdate(db *Db) error {
-	err := DbValidate(db)
+func DbUpdate(ctx context.Context, db *Db) error {
+	err := DbValidate(ctx, db)
 	if err != nil {
 		return err
 	}
 	db.UpdatedAt = time.Now()
-	result, err := PgConn.Exec("UPDATE dbs SET name=$1, url_encrypted=$2, created_at=$3, updated_at=$4, deleted_at=$5, version=$6 WHERE id=$7 AND version=$8",
-		db.Name, FernetEncrypt(db.Url), db.AddedAt, db.UpdatedAt, db.RemovedAt, db.Version+1, db.Id, db.Version)
+	result, err := PgConn.ExecContext(ctx, "UPDATE dbs SET name=$1, url_encrypted=$2, max_queries=$3, created_at=$4, updated_at=$5, deleted_at=$6, version=$7 WHERE id=$8 AND version=$9",
+		db.Name, FernetEncrypt(db.Url), db.MaxQueries, db.AddedAt, db.UpdatedAt, db.RemovedAt, db.Version+1, db.Id, db.Version)
 	if err != nil {
 		return err
 	}
@@ -158,19 +227,20 @@ func DbUpdate(db *Db) error {
 		return &PgpinError{
 			Id:         "db-concurrent-update",
 			Message:    "concurrent db update attempted",
-			HttpStatus: 400,
+			HttpStatus: 409,
 		}
 	}
 	db.Version = db.Version + 1
+	log.Printf("db.update request_id=%s db_id=%s version=%d", ContextRequestId(ctx), db.Id, db.Version)
 	return nil
 }
 
-func DbDelete(id string) (*Db, error) {
-	db, err := DbGet(id)
+func DbDelete(ctx context.Context, id string) (*Db, error) {
+	db, err := DbGet(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	numPins, err := PgCount("SELECT count(*) FROM pins WHERE db_id=$1 AND deleted_at IS NULL", db.Id)
+	numPins, err := PgCount(ctx, "SELECT count(*) FROM pins WHERE db_id=$1 AND deleted_at IS NULL", db.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -183,13 +253,13 @@ func DbDelete(id string) (*Db, error) {
 	}
 	removedAt := time.Now()
 	db.RemovedAt = &removedAt
-	err = DbUpdate(db)
+	err = DbUpdate(ctx, db)
 	return db, err
 }
 
 // Pin operations.
 
-func PinValidate(pin *Pin) error {
+func PinValidate(ctx context.Context, pin *Pin) error {
 	err := ValidateSlug("name", pin.Name)
 	if err != nil {
 		return err
@@ -198,11 +268,15 @@ func PinValidate(pin *Pin) error {
 	if err != nil {
 		return err
 	}
-	_, err = DbGet(pin.DbId)
+	err = ValidateRange("max_rows", pin.MaxRows, 1, ConfigPinResultsRowsMax)
+	if err != nil {
+		return err
+	}
+	_, err = DbGet(ctx, pin.DbId)
 	if err != nil {
 		return err
 	}
-	sameNamed, err := PgCount("SELECT count(*) FROM pins WHERE name=$1 AND id!=$2 AND deleted_at IS NULL", pin.Name, pin.Id)
+	sameNamed, err := PgCount(ctx, "SELECT count(*) FROM pins WHERE name=$1 AND id!=$2 AND deleted_at IS NULL", pin.Name, pin.Id)
 	if err != nil {
 		return err
 	} else if sameNamed > 0 {
@@ -215,12 +289,12 @@ func PinValidate(pin *Pin) error {
 	return nil
 }
 
-func PinList(queryFrag string, queryVals ...interface{}) ([]*Pin, error) {
+func PinList(ctx context.Context, queryFrag string, queryVals ...interface{}) ([]*Pin, error) {
 	if queryFrag == "" {
 		queryFrag = "true"
 	}
-	query := "SELECT id, name, db_id, query, created_at, updated_at, query_started_at, query_finished_at, results_fields, results_rows, results_error, scheduled_at, deleted_at, version FROM pins WHERE deleted_at IS NULL AND " + queryFrag
-	res, err := PgConn.Query(query, queryVals...)
+	query := "SELECT id, name, db_id, query, max_rows, created_at, updated_at, query_started_at, query_finished_at, query_attempts, results_fields, results_columns, results_truncated, results_row_count, results_size, results_error, results_key, scheduled_at, deleted_at, version FROM pins WHERE deleted_at IS NULL AND " + queryFrag
+	res, err := PgConn.QueryContext(ctx, query, queryVals...)
 	if err != nil {
 		return nil, err
 	}
@@ -228,7 +302,7 @@ func PinList(queryFrag string, queryVals ...interface{}) ([]*Pin, error) {
 	pins := []*Pin{}
 	for res.Next() {
 		pin := Pin{}
-		err := res.Scan(&pin.Id, &pin.Name, &pin.DbId, &pin.Query, &pin.CreatedAt, &pin.UpdatedAt, &pin.QueryStartedAt, &pin.QueryFinishedAt, &pin.ResultsFields, &pin.ResultsRows, &pin.ResultsError, &pin.ScheduledAt, &pin.DeletedAt, &pin.Version)
+		err := res.Scan(&pin.Id, &pin.Name, &pin.DbId, &pin.Query, &pin.MaxRows, &pin.CreatedAt, &pin.UpdatedAt, &pin.QueryStartedAt, &pin.QueryFinishedAt, &pin.QueryAttempts, &pin.ResultsFields, &pin.ResultsColumns, &pin.ResultsTruncated, &pin.ResultsRowCount, &pin.ResultsSize, &pin.ResultsError, &pin.ResultsKey, &pin.ScheduledAt, &pin.DeletedAt, &pin.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -241,44 +315,51 @@ func PinList(queryFrag string, queryVals ...interface{}) ([]*Pin, error) {
 	return pins, nil
 }
 
-func PinCreate(dbId string, name string, query string) (*Pin, error) {
+func PinCreate(ctx context.Context, dbId string, name string, query string, maxRows int) (*Pin, error) {
 	now := time.Now()
 	pin := &Pin{
-		Id:              uuid.New(),
-		Name:            name,
-		DbId:            dbId,
-		Query:           query,
-		CreatedAt:       now,
-		UpdatedAt:       now,
-		QueryStartedAt:  nil,
-		QueryFinishedAt: nil,
-		ResultsFields:   MustNewPgJson(nil),
-		ResultsRows:     MustNewPgJson(nil),
-		ResultsError:    nil,
-		ScheduledAt:     now,
-		DeletedAt:       nil,
-		Version:         1,
-	}
-	err := PinValidate(pin)
+		Id:               uuid.New(),
+		Name:             name,
+		DbId:             dbId,
+		Query:            query,
+		MaxRows:          maxRows,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		QueryStartedAt:   nil,
+		QueryFinishedAt:  nil,
+		QueryAttempts:    0,
+		ResultsFields:    MustNewPgJson(nil),
+		ResultsColumns:   MustNewPgJson(nil),
+		ResultsTruncated: false,
+		ResultsRowCount:  nil,
+		ResultsSize:      0,
+		ResultsError:     nil,
+		ResultsKey:       nil,
+		ScheduledAt:      now,
+		DeletedAt:        nil,
+		Version:          1,
+	}
+	err := PinValidate(ctx, pin)
 	if err != nil {
 		return nil, err
 	}
-	_, err = PgConn.Exec("INSERT INTO pins (id, name, db_id, query, created_at, updated_at, query_started_at, query_finished_at, results_fields, results_rows, results_error, scheduled_at, deleted_at, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)",
-		pin.Id, pin.Name, pin.DbId, pin.Query, pin.CreatedAt, pin.UpdatedAt, pin.QueryStartedAt, pin.QueryFinishedAt, pin.ResultsFields, pin.ResultsRows, pin.ResultsError, pin.ScheduledAt, pin.DeletedAt, pin.Version)
+	_, err = PgConn.ExecContext(ctx, "INSERT INTO pins (id, name, db_id, query, max_rows, created_at, updated_at, query_started_at, query_finished_at, query_attempts, results_fields, results_columns, results_truncated, results_row_count, results_size, results_error, results_key, scheduled_at, deleted_at, version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)",
+		pin.Id, pin.Name, pin.DbId, pin.Query, pin.MaxRows, pin.CreatedAt, pin.UpdatedAt, pin.QueryStartedAt, pin.QueryFinishedAt, pin.QueryAttempts, pin.ResultsFields, pin.ResultsColumns, pin.ResultsTruncated, pin.ResultsRowCount, pin.ResultsSize, pin.ResultsError, pin.ResultsKey, pin.ScheduledAt, pin.DeletedAt, pin.Version)
 	if err != nil {
 		return nil, err
 	}
-	err = workers.Enqueue("pins", "", pin.Id)
+	log.Printf("pin.create request_id=%s pin_id=%s db_id=%s", ContextRequestId(ctx), pin.Id, pin.DbId)
+	err = WorkerEnqueue(ctx, pin.Id, WorkerPriorityInteractive)
 	if err != nil {
 		return nil, err
 	}
 	return pin, nil
 }
 
-func PinGetInternal(queryFrag string, queryVals ...interface{}) (*Pin, error) {
-	row := PgConn.QueryRow("SELECT id, name, db_id, query, created_at, updated_at, query_started_at, query_finished_at, results_fields, results_rows, results_error, scheduled_at, deleted_at, version FROM pins WHERE deleted_at IS NULL AND "+queryFrag+" LIMIT 1", queryVals...)
+func PinGetInternal(ctx context.Context, queryFrag string, queryVals ...interface{}) (*Pin, error) {
+	row := PgConn.QueryRowContext(ctx, "SELECT id, name, db_id, query, max_rows, created_at, updated_at, query_started_at, query_finished_at, query_attempts, results_fields, results_columns, results_truncated, results_row_count, results_size, results_error, results_key, scheduled_at, deleted_at, version FROM pins WHERE deleted_at IS NULL AND "+queryFrag+" LIMIT 1", queryVals...)
 	pin := Pin{}
-	err := row.Scan(&pin.Id, &pin.Name, &pin.DbId, &pin.Query, &pin.CreatedAt, &pin.UpdatedAt, &pin.QueryStartedAt, &pin.QueryFinishedAt, &pin.ResultsFields, &pin.ResultsRows, &pin.ResultsError, &pin.ScheduledAt, &pin.DeletedAt, &pin.Version)
+	err := row.Scan(&pin.Id, &pin.Name, &pin.DbId, &pin.Query, &pin.MaxRows, &pin.CreatedAt, &pin.UpdatedAt, &pin.QueryStartedAt, &pin.QueryFinishedAt, &pin.QueryAttempts, &pin.ResultsFields, &pin.ResultsColumns, &pin.ResultsTruncated, &pin.ResultsRowCount, &pin.ResultsSize, &pin.ResultsError, &pin.ResultsKey, &pin.ScheduledAt, &pin.DeletedAt, &pin.Version)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, nil
@@ -289,13 +370,13 @@ func PinGetInternal(queryFrag string, queryVals ...interface{}) (*Pin, error) {
 	}
 }
 
-func PinGet(idOrName string) (*Pin, error) {
+func PinGet(ctx context.Context, idOrName string) (*Pin, error) {
 	var pin *Pin
 	var err error
 	if DataUuidRegexp.MatchString(idOrName) {
-		pin, err = PinGetInternal("(id=$1 OR name=$2)", idOrName, idOrName)
+		pin, err = PinGetInternal(ctx, "(id=$1 OR name=$2)", idOrName, idOrName)
 	} else {
-		pin, err = PinGetInternal("name=$1", idOrName)
+		pin, err = PinGetInternal(ctx, "name=$1", idOrName)
 	}
 	if err != nil {
 		return nil, err
@@ -310,14 +391,43 @@ func PinGet(idOrName string) (*Pin, error) {
 	return pin, nil
 }
 
-func PinUpdate(pin *Pin) error {
-	err := PinValidate(pin)
+// PinUpdate saves pin, failing if it's been updated concurrently.
+// The pin's scheduled_at isn't saved, as it's only set by the
+// scheduler when it claims the pin for a refresh. If the pin has
+// new Results they're stored under a new key, and the blob for the
+// previous results is deleted once the pin is saved. If the pin
+// isn't saved, the new blob is deleted instead, even if ctx has been
+// cancelled.
+func PinUpdate(ctx context.Context, pin *Pin) error {
+	err := PinValidate(ctx, pin)
 	if err != nil {
 		return err
 	}
+	prevKey := pin.ResultsKey
+	if pin.Results != nil {
+		err = PinStoreResults(ctx, pin)
+		if err != nil {
+			return err
+		}
+	}
+	err = pinUpdate(ctx, pin)
+	if pin.Results != nil {
+		if err != nil {
+			cleanupCtx := ContextWithRequestId(context.Background(), ContextRequestId(ctx))
+			pinDeleteResults(cleanupCtx, pin.ResultsKey)
+			pin.ResultsKey = prevKey
+		} else {
+			pinDeleteResults(ctx, prevKey)
+			pin.Results = nil
+		}
+	}
+	return err
+}
+
+func pinUpdate(ctx context.Context, pin *Pin) error {
 	pin.UpdatedAt = time.Now()
-	result, err := PgConn.Exec("UPDATE pins SET db_id=$1, name=$2, query=$3, created_at=$4, updated_at=$5, query_started_at=$6, query_finished_at=$7, results_fields=$8, results_rows=$9, results_error=$10, scheduled_at=$11, deleted_at=$12, version=$13 WHERE id=$14 AND version=$15",
-		pin.DbId, pin.Name, pin.Query, pin.CreatedAt, pin.UpdatedAt, pin.QueryStartedAt, pin.QueryFinishedAt, pin.ResultsFields, pin.ResultsRows, pin.ResultsError, pin.ScheduledAt, pin.DeletedAt, pin.Version+1, pin.Id, pin.Version)
+	result, err := PgConn.ExecContext(ctx, "UPDATE pins SET db_id=$1, name=$2, query=$3, max_rows=$4, created_at=$5, updated_at=$6, query_started_at=$7, query_finished_at=$8, query_attempts=$9, results_fields=$10, results_columns=$11, results_truncated=$12, results_row_count=$13, results_size=$14, results_error=$15, results_key=$16, results_rows=CASE WHEN $16::text IS NULL THEN results_rows END, results_sets=CASE WHEN $16::text IS NULL THEN results_sets END, deleted_at=$17, version=$18 WHERE id=$19 AND version=$20",
+		pin.DbId, pin.Name, pin.Query, pin.MaxRows, pin.CreatedAt, pin.UpdatedAt, pin.QueryStartedAt, pin.QueryFinishedAt, pin.QueryAttempts, pin.ResultsFields, pin.ResultsColumns, pin.ResultsTruncated, pin.ResultsRowCount, pin.ResultsSize, pin.ResultsError, pin.ResultsKey, pin.DeletedAt, pin.Version+1, pin.Id, pin.Version)
 	if err != nil {
 		return err
 	}
@@ -329,31 +439,289 @@ func PinUpdate(pin *Pin) error {
 		return &PgpinError{
 			Id:         "pin-concurrent-update",
 			Message:    "concurrent pin updated attempted",
-			HttpStatus: 400,
+			HttpStatus: 409,
 		}
 	}
 	pin.Version = pin.Version + 1
+	log.Printf("pin.update request_id=%s pin_id=%s version=%d", ContextRequestId(ctx), pin.Id, pin.Version)
+	return nil
+}
+
+// PinStoreResults encodes the pin's Results and puts them in
+// BlobBackend under a new key, recording the key and the stored
+// size on the pin.
+func PinStoreResults(ctx context.Context, pin *Pin) error {
+	data, err := ResultsEncode(pin.Results)
+	if err != nil {
+		return err
+	}
+	key := "pins/" + pin.Id + "/" + uuid.New()
+	err = BlobBackend.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+	pin.ResultsKey = &key
+	pin.ResultsSize = len(data)
 	return nil
 }
 
-func PinDelete(id string) (*Pin, error) {
-	pin, err := PinGet(id)
+// PinLoadResults sets the pin's ResultsSets from BlobBackend, or
+// from the legacy columns for pins without a ResultsKey, and
+// ResultsRows from the last result set. As with PinOpenResults, the
+// pin is read again if it was run since it was read.
+func PinLoadResults(ctx context.Context, pin *Pin) error {
+	blob, err := pinOpenBlob(ctx, pin)
+	if err != nil {
+		return err
+	}
+	var sets []*PinResultsSet
+	if blob != nil {
+		defer func() { Must(blob.Close()) }()
+		sets, err = ResultsDecode(blob)
+	} else {
+		sets, err = pinLegacyResults(ctx, pin)
+	}
+	if err != nil {
+		return err
+	}
+	if len(sets) == 0 {
+		pin.ResultsRows = MustNewPgJson(nil)
+		pin.ResultsSets = MustNewPgJson(nil)
+		return nil
+	}
+	pin.ResultsRows = MustNewPgJson(sets[len(sets)-1].Rows)
+	pin.ResultsSets = MustNewPgJson(sets)
+	return nil
+}
+
+// PinOpenResults opens the pin's results as encoded by
+// ResultsEncode, from BlobBackend or, for pins without a ResultsKey,
+// by encoding their legacy results. It fails with a 404 if the pin
+// has no results. If the pin was run since it was read, its results
+// blob will have been replaced, so the pin is read again into pin
+// and its current results opened.
+func PinOpenResults(ctx context.Context, pin *Pin) (io.ReadCloser, error) {
+	blob, err := pinOpenBlob(ctx, pin)
+	if blob != nil || err != nil {
+		return blob, err
+	}
+	sets, err := pinLegacyResults(ctx, pin)
+	if err != nil {
+		return nil, err
+	}
+	if sets == nil {
+		return nil, &PgpinError{
+			Id:         "results-not-found",
+			Message:    "pin has no results yet",
+			HttpStatus: 404,
+		}
+	}
+	data, err := ResultsEncode(sets)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// pinOpenBlob opens the pin's results blob, or returns nil if it has
+// none. Runs delete the blob they replace, so a missing blob is
+// taken to mean that the pin was run since it was read, in which
+// case it's read again and its new blob opened.
+func pinOpenBlob(ctx context.Context, pin *Pin) (io.ReadCloser, error) {
+	for pin.ResultsKey != nil {
+		blob, err := BlobBackend.Open(ctx, *pin.ResultsKey)
+		if err != ErrBlobNotFound {
+			return blob, err
+		}
+		current, err := PinGet(ctx, pin.Id)
+		if err != nil {
+			return nil, err
+		}
+		if current.Version == pin.Version {
+			return nil, ErrBlobNotFound
+		}
+		*pin = *current
+	}
+	return nil, nil
+}
+
+// pinLegacyResults returns the result sets stored in the pin's
+// legacy results_sets column or, for pins last run before pins had
+// several result sets, a single set built from results_rows and the
+// pin's other results fields. It returns nil if there are neither.
+// Numbers are decoded as json.Numbers so that they're re-encoded
+// exactly as stored.
+func pinLegacyResults(ctx context.Context, pin *Pin) ([]*PinResultsSet, error) {
+	row := PgConn.QueryRowContext(ctx, "SELECT results_rows, results_sets FROM pins WHERE id=$1", pin.Id)
+	var rowsJson, setsJson []byte
+	err := row.Scan(&rowsJson, &setsJson)
+	if err != nil {
+		return nil, err
+	}
+	if setsJson != nil {
+		sets := []*PinResultsSet{}
+		err = pinDecodeLegacy(setsJson, &sets)
+		return sets, err
+	}
+	if rowsJson == nil {
+		return nil, nil
+	}
+	set := &PinResultsSet{Truncated: pin.ResultsTruncated, Error: pin.ResultsError}
+	err = pinDecodeLegacy(rowsJson, &set.Rows)
+	if err == nil {
+		err = pinDecodeLegacy(pin.ResultsFields, &set.Fields)
+	}
+	if err == nil {
+		err = pinDecodeLegacy(pin.ResultsColumns, &set.Columns)
+	}
+	if err != nil {
+		return nil, err
+	}
+	set.RowCount = len(set.Rows)
+	if pin.ResultsRowCount != nil {
+		set.RowCount = *pin.ResultsRowCount
+	}
+	return []*PinResultsSet{set}, nil
+}
+
+func pinDecodeLegacy(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// pinDeleteResults deletes the results blob with the given key, if
+// any. Failures only leave an unreferenced blob, so are logged.
+func pinDeleteResults(ctx context.Context, key *string) {
+	if key == nil {
+		return
+	}
+	err := BlobBackend.Delete(ctx, *key)
+	if err != nil {
+		log.Printf("pin.results.error request_id=%s key=%s %s", ContextRequestId(ctx), *key, err)
+	}
+}
+
+func PinDelete(ctx context.Context, id string) (*Pin, error) {
+	pin, err := PinGet(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 	deletedAt := time.Now()
 	pin.DeletedAt = &deletedAt
-	err = PinUpdate(pin)
+	err = PinUpdate(ctx, pin)
 	if err != nil {
 		return nil, err
 	}
 	return pin, nil
 }
 
-func PinDbUrl(pin *Pin) (string, error) {
-	db, err := DbGet(pin.DbId)
+// PinOldestRefresh returns the time at which the least recently
+// refreshed pin was last run, or created if it hasn't been run, or
+// nil if there are no pins.
+func PinOldestRefresh(ctx context.Context) (*time.Time, error) {
+	row := PgConn.QueryRowContext(ctx, "SELECT min(coalesce(query_finished_at, created_at)) FROM pins WHERE deleted_at IS NULL")
+	var oldest *time.Time
+	err := row.Scan(&oldest)
+	if err != nil {
+		return nil, err
+	}
+	return oldest, nil
+}
+
+func PinDb(ctx context.Context, pin *Pin) (*Db, error) {
+	return DbGet(ctx, pin.DbId)
+}
+
+// Dead job operations.
+
+// DeadJobCreate records a pin job that failed without being
+// retried, so that it can be inspected and replayed later.
+func DeadJobCreate(ctx context.Context, jobId string, job *WorkerJob, jobErr string, stack *string) (*DeadJob, error) {
+	deadJob := &DeadJob{
+		Id:         uuid.New(),
+		JobId:      jobId,
+		PinId:      job.PinId,
+		RequestId:  job.RequestId,
+		Attempts:   job.Attempt,
+		Error:      jobErr,
+		Stack:      stack,
+		CreatedAt:  time.Now(),
+		ReplayedAt: nil,
+	}
+	_, err := PgConn.ExecContext(ctx, "INSERT INTO dead_jobs (id, job_id, pin_id, request_id, attempts, error, stack, created_at, replayed_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		deadJob.Id, deadJob.JobId, deadJob.PinId, deadJob.RequestId, deadJob.Attempts, deadJob.Error, deadJob.Stack, deadJob.CreatedAt, deadJob.ReplayedAt)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("dead_job.create request_id=%s dead_job_id=%s job_id=%s pin_id=%s", deadJob.RequestId, deadJob.Id, deadJob.JobId, deadJob.PinId)
+	return deadJob, nil
+}
+
+func DeadJobList(ctx context.Context) ([]*DeadJob, error) {
+	res, err := PgConn.QueryContext(ctx, "SELECT id, job_id, pin_id, request_id, attempts, error, stack, created_at, replayed_at FROM dead_jobs ORDER BY created_at")
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer func() { Must(res.Close()) }()
+	deadJobs := []*DeadJob{}
+	for res.Next() {
+		deadJob := DeadJob{}
+		err := res.Scan(&deadJob.Id, &deadJob.JobId, &deadJob.PinId, &deadJob.RequestId, &deadJob.Attempts, &deadJob.Error, &deadJob.Stack, &deadJob.CreatedAt, &deadJob.ReplayedAt)
+		if err != nil {
+			return nil, err
+		}
+		deadJobs = append(deadJobs, &deadJob)
+	}
+	err = res.Err()
+	if err != nil {
+		return nil, err
+	}
+	return deadJobs, nil
+}
+
+func DeadJobGet(ctx context.Context, id string) (*DeadJob, error) {
+	notFound := &PgpinError{
+		Id:         "dead-job-not-found",
+		Message:    "dead job not found",
+		HttpStatus: 404,
+	}
+	if !DataUuidRegexp.MatchString(id) {
+		return nil, notFound
+	}
+	row := PgConn.QueryRowContext(ctx, "SELECT id, job_id, pin_id, request_id, attempts, error, stack, created_at, replayed_at FROM dead_jobs WHERE id=$1", id)
+	deadJob := DeadJob{}
+	err := row.Scan(&deadJob.Id, &deadJob.JobId, &deadJob.PinId, &deadJob.RequestId, &deadJob.Attempts, &deadJob.Error, &deadJob.Stack, &deadJob.CreatedAt, &deadJob.ReplayedAt)
+	switch {
+	case err == nil:
+		return &deadJob, nil
+	case err == sql.ErrNoRows:
+		return nil, notFound
+	default:
+		return nil, err
+	}
+}
+
+// DeadJobReplay enqueues a fresh run of the dead job's pin, under
+// the request id from ctx, and marks the dead job as replayed.
+func DeadJobReplay(ctx context.Context, id string) (*DeadJob, error) {
+	deadJob, err := DeadJobGet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = WorkerEnqueue(ctx, deadJob.PinId, WorkerPriorityInteractive)
+	if err != nil {
+		return nil, err
+	}
+	replayedAt := time.Now()
+	deadJob.ReplayedAt = &replayedAt
+	_, err = PgConn.ExecContext(ctx, "UPDATE dead_jobs SET replayed_at=$1 WHERE id=$2", deadJob.ReplayedAt, deadJob.Id)
+	if err != nil {
+		return nil, err
 	}
-	return db.Url, nil
+	log.Printf("dead_job.replay request_id=%s dead_job_id=%s pin_id=%s", ContextRequestId(ctx), deadJob.Id, deadJob.PinId)
+	return deadJob, nil
 }
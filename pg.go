@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/lib/pq"
@@ -17,7 +18,7 @@ func PgStart() {
 		ConfigDatabaseUrl,
 		"pgpin.api",
 		ConfigDatabaseStatementTimeout/time.Millisecond,
-		ConfigDatabaseConnectTimeout/time.Millisecond)
+		ConfigDatabaseConnectTimeout/time.Second)
 	conn, err := sql.Open("postgres", connUrl)
 	if err != nil {
 		panic(err)
@@ -26,8 +27,8 @@ func PgStart() {
 	PgConn = conn
 }
 
-func PgCount(query string, args ...interface{}) (int, error) {
-	row := PgConn.QueryRow(query, args...)
+func PgCount(ctx context.Context, query string, args ...interface{}) (int, error) {
+	row := PgConn.QueryRowContext(ctx, query, args...)
 	var count int
 	err := row.Scan(&count)
 	if err != nil {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PgArrayParse parses the text representation of a Postgres array,
+// such as {1,2,NULL} or {{"a b",c},{d,e}}. Elements are returned as
+// strings, nils for NULLs, or nested []interface{}s for the inner
+// dimensions of multidimensional arrays. A leading dimension
+// decoration like [0:1]= is ignored.
+func PgArrayParse(s string) ([]interface{}, error) {
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("pg_array: malformed dimensions in %q", s)
+		}
+		s = s[i+1:]
+	}
+	p := &pgArrayParser{s: s}
+	elems, err := p.parseArray()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("pg_array: unexpected trailing input in %q", s)
+	}
+	return elems, nil
+}
+
+type pgArrayParser struct {
+	s   string
+	pos int
+}
+
+func (p *pgArrayParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("pg_array: %s at offset %d in %q", fmt.Sprintf(format, args...), p.pos, p.s)
+}
+
+func (p *pgArrayParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *pgArrayParser) parseArray() ([]interface{}, error) {
+	if p.peek() != '{' {
+		return nil, p.errorf("expected {")
+	}
+	p.pos++
+	elems := []interface{}{}
+	if p.peek() == '}' {
+		p.pos++
+		return elems, nil
+	}
+	for {
+		var elem interface{}
+		var err error
+		switch p.peek() {
+		case '{':
+			elem, err = p.parseArray()
+		case '"':
+			elem, err = p.parseQuoted()
+		default:
+			elem, err = p.parseUnquoted()
+		}
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return elems, nil
+		default:
+			return nil, p.errorf("expected , or }")
+		}
+	}
+}
+
+func (p *pgArrayParser) parseQuoted() (interface{}, error) {
+	p.pos++
+	b := strings.Builder{}
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.pos >= len(p.s) {
+				return nil, p.errorf("unterminated escape")
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case '"':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, p.errorf("unterminated quoted element")
+}
+
+func (p *pgArrayParser) parseUnquoted() (interface{}, error) {
+	b := strings.Builder{}
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case ',', '}':
+			elem := strings.TrimSpace(b.String())
+			if elem == "" {
+				return nil, p.errorf("empty element")
+			}
+			if strings.EqualFold(elem, "NULL") {
+				return nil, nil
+			}
+			return elem, nil
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.s) {
+				return nil, p.errorf("unterminated escape")
+			}
+			b.WriteByte(p.s[p.pos])
+		default:
+			b.WriteByte(c)
+		}
+		p.pos++
+	}
+	return nil, p.errorf("unterminated array")
+}
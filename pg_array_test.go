@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPgArrayParse(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []interface{}
+	}{
+		{`{}`, []interface{}{}},
+		{`{1,2,3}`, []interface{}{"1", "2", "3"}},
+		{`{a,NULL,null}`, []interface{}{"a", nil, nil}},
+		{`{"a b","c,d","e\"f","g\\h","NULL"}`, []interface{}{"a b", "c,d", `e"f`, `g\h`, "NULL"}},
+		{`{{1,2},{3,4}}`, []interface{}{[]interface{}{"1", "2"}, []interface{}{"3", "4"}}},
+		{`[0:1]={5,6}`, []interface{}{"5", "6"}},
+	}
+	for _, c := range cases {
+		out, err := PgArrayParse(c.in)
+		assert.Nil(t, err, c.in)
+		assert.Equal(t, c.out, out, c.in)
+	}
+	for _, in := range []string{``, `{1,2`, `{"a}`, `{1,,2}`, `{1}x`} {
+		_, err := PgArrayParse(in)
+		assert.NotNil(t, err, in)
+	}
+}
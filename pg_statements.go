@@ -0,0 +1,100 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var pgDollarTagRegexp = regexp.MustCompile(`\A\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// PgSplitStatements splits sql into its individual statements on
+// semicolons, respecting string literals, quoted identifiers,
+// dollar quoting and comments. Statements are returned trimmed and
+// without their terminating semicolons; empty statements, including
+// those consisting only of comments, are dropped.
+func PgSplitStatements(sql string) []string {
+	statements := []string{}
+	start := 0
+	empty := true
+	flush := func(end int) {
+		if !empty {
+			statements = append(statements, strings.TrimSpace(sql[start:end]))
+		}
+		start = end + 1
+		empty = true
+	}
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == ';':
+			flush(i)
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			depth := 0
+			for ; i < len(sql); i++ {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i++
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case c == '\'':
+			empty = false
+			escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i < 2 || !pgIdentByte(sql[i-2]))
+			for i++; i < len(sql); i++ {
+				if escapes && sql[i] == '\\' {
+					i++
+				} else if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case c == '"':
+			empty = false
+			for i++; i < len(sql); i++ {
+				if sql[i] == '"' {
+					if i+1 < len(sql) && sql[i+1] == '"' {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case c == '$' && (i == 0 || !pgIdentByte(sql[i-1])):
+			empty = false
+			tag := pgDollarTagRegexp.FindString(sql[i:])
+			if tag == "" {
+				continue
+			}
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+		default:
+			empty = false
+		}
+	}
+	flush(len(sql))
+	return statements
+}
+
+func pgIdentByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPgSplitStatements(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []string
+	}{
+		{`select 1`, []string{`select 1`}},
+		{`select 1;`, []string{`select 1`}},
+		{`set search_path = a; select 1`, []string{`set search_path = a`, `select 1`}},
+		{`select ';', "a;b"; select 'it''s;'`, []string{`select ';', "a;b"`, `select 'it''s;'`}},
+		{`select E'\';'; select 2`, []string{`select E'\';'`, `select 2`}},
+		{`select $$;$$, $x$ $$; $x$; select $1`, []string{`select $$;$$, $x$ $$; $x$`, `select $1`}},
+		{"-- a;\nselect 1; /* b; /* c; */ d; */ select 2; -- e", []string{"-- a;\nselect 1", "/* b; /* c; */ d; */ select 2"}},
+		{` ; ;`, []string{}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.out, PgSplitStatements(c.in), c.in)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jrallison/go-workers"
+	"github.com/lib/pq"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// QueueJob is a job taken from a queue. Payload is the JSON
+// encoding of the value the job was enqueued with.
+type QueueJob struct {
+	Id      string
+	Queue   string
+	Payload []byte
+}
+
+// QueueHandler runs a job taken from a queue. The job is
+// acknowledged once the handler returns, unless the queue's Run
+// context is done by then, in which case the job was likely
+// interrupted and is put back to be run again.
+type QueueHandler func(ctx context.Context, job *QueueJob)
+
+// Queue is implemented by job queue backends.
+type Queue interface {
+	// Enqueue adds a job with the given payload to the named queue,
+	// to be run no earlier than at.
+	Enqueue(ctx context.Context, queue string, payload interface{}, at time.Time) error
+	// Run processes jobs from the named queues with the given
+	// concurrency until ctx is done, then waits for jobs in flight.
+	// Queues are given in priority order: a job is only taken from a
+	// queue when all the queues before it have no jobs ready.
+	Run(ctx context.Context, queues []string, concurrency int, handler QueueHandler)
+	// Depth returns the number of jobs ready to run on the named
+	// queue but not yet taken by a worker.
+	Depth(ctx context.Context, queue string) (int, error)
+}
+
+// QueueBackend is the queue used for pin jobs, as selected by
+// ConfigQueueBackend.
+var QueueBackend Queue
+
+// QueueStart configures QueueBackend according to the environment.
+// Redis is only connected to when it backs the queue.
+func QueueStart() {
+	log.Printf("queue.start backend=%s", ConfigQueueBackend)
+	switch ConfigQueueBackend {
+	case "redis":
+		RedisStart()
+		QueueBackend = QueueNewRedis()
+	case "postgres":
+		QueueBackend = QueueNewPg()
+	default:
+		panic(fmt.Sprintf("queue: unknown backend %q", ConfigQueueBackend))
+	}
+}
+
+// queueWait waits for ConfigQueuePollInterval before looking for
+// jobs again, returning early if ctx is done.
+func queueWait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(ConfigQueuePollInterval):
+	}
+}
+
+// queueHandle runs handler on job, recovering from any panic so
+// that one bad job can't take down the process. The job is then
+// acknowledged as usual, rather than being run again to panic again.
+func queueHandle(ctx context.Context, job *QueueJob, handler QueueHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("queue.panic queue=%s job_id=%s %s", job.Queue, job.Id, err)
+			log.Print(string(debug.Stack()))
+			ReportPanic("queue", err, map[string]string{"job_id": job.Id})
+		}
+	}()
+	handler(ctx, job)
+}
+
+// Redis.
+
+// QueueRedis is a queue backed by Redis, with jobs in the
+// go-workers format. Jobs to be run later are held in the
+// go-workers schedule. go-workers runs each queue with its own
+// workers, so jobs are instead taken here, trying queues in
+// priority order. A taken job is held in its process's in-progress
+// list until handled. As with QueuePg's claims, each process holds
+// its lists for ConfigQueueLockTtl and renews them while running,
+// and the lists of processes that stop renewing, as after a crash,
+// are requeued by the others.
+type QueueRedis struct {
+	Holder string
+}
+
+func QueueNewRedis() *QueueRedis {
+	return &QueueRedis{Holder: uuid.New()}
+}
+
+func (q *QueueRedis) Enqueue(ctx context.Context, queue string, payload interface{}, at time.Time) error {
+	if at.After(time.Now()) {
+		return RedisEnqueueAt(queue, payload, at)
+	}
+	return workers.Enqueue(queue, "", payload)
+}
+
+func (q *QueueRedis) inprogress(queue string) string {
+	return queueRedisInprogress(q.Holder, queue)
+}
+
+func queueRedisInprogress(holder string, queue string) string {
+	return "queue:" + queue + ":" + holder + ":inprogress"
+}
+
+// Take moves the next ready job from the first of the named queues
+// that has one to its in-progress list, returning nil if none do.
+func (q *QueueRedis) Take(queues []string) (*QueueJob, *workers.Msg, error) {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	for _, queue := range queues {
+		message, err := redis.String(conn.Do("rpoplpush", "queue:"+queue, q.inprogress(queue)))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		msg, err := workers.NewMsg(message)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload, err := msg.Args().Encode()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &QueueJob{Id: msg.Jid(), Queue: queue, Payload: payload}, msg, nil
+	}
+	return nil, nil, nil
+}
+
+// Hold marks q's in-progress lists as held for ConfigQueueLockTtl.
+func (q *QueueRedis) Hold() error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err := conn.Do("set", "queue:holder:"+q.Holder, time.Now().Unix(), "px", int64(ConfigQueueLockTtl/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("sadd", "queue:holders", q.Holder)
+	return err
+}
+
+// Unhold gives up q's in-progress lists, which should be empty.
+func (q *QueueRedis) Unhold() error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err := conn.Do("del", "queue:holder:"+q.Holder)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("srem", "queue:holders", q.Holder)
+	return err
+}
+
+// Recover moves any jobs in the in-progress lists of holders whose
+// hold has expired back to their queues.
+func (q *QueueRedis) Recover(queues []string) error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	holders, err := redis.Strings(conn.Do("smembers", "queue:holders"))
+	if err != nil {
+		return err
+	}
+	for _, holder := range holders {
+		held, err := redis.Bool(conn.Do("exists", "queue:holder:"+holder))
+		if err != nil {
+			return err
+		}
+		if held {
+			continue
+		}
+		for _, queue := range queues {
+			count := 0
+			for {
+				_, err := redis.String(conn.Do("rpoplpush", queueRedisInprogress(holder, queue), "queue:"+queue))
+				if err == redis.ErrNil {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				count++
+			}
+			if count > 0 {
+				log.Printf("queue.recover queue=%s holder=%s count=%d", queue, holder, count)
+			}
+		}
+		_, err = conn.Do("srem", "queue:holders", holder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keep renews q's hold and recovers the jobs of expired holders
+// every third of ConfigQueueLockTtl until ctx is done.
+func (q *QueueRedis) keep(ctx context.Context, queues []string) {
+	ticker := time.NewTicker(ConfigQueueLockTtl / 3)
+	defer ticker.Stop()
+	for {
+		err := q.Hold()
+		if err == nil {
+			err = q.Recover(queues)
+		}
+		if err != nil {
+			log.Printf("queue.error holder=%s %s", q.Holder, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Complete removes a handled job from its in-progress list.
+func (q *QueueRedis) Complete(job *QueueJob, msg *workers.Msg) error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err := conn.Do("lrem", q.inprogress(job.Queue), -1, msg.OriginalJson())
+	return err
+}
+
+// Release moves a job interrupted by shutdown from its in-progress
+// list back to the end of its queue that jobs are taken from, so
+// that it's the next to run.
+func (q *QueueRedis) Release(job *QueueJob, msg *workers.Msg) error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	err := conn.Send("multi")
+	if err == nil {
+		err = conn.Send("lrem", q.inprogress(job.Queue), -1, msg.OriginalJson())
+	}
+	if err == nil {
+		err = conn.Send("rpush", "queue:"+job.Queue, msg.OriginalJson())
+	}
+	if err == nil {
+		_, err = conn.Do("exec")
+	}
+	return err
+}
+
+func (q *QueueRedis) Run(ctx context.Context, queues []string, concurrency int, handler QueueHandler) {
+	err := q.Hold()
+	if err != nil {
+		log.Printf("queue.error holder=%s %s", q.Holder, err)
+	}
+	keepCtx, stopKeep := context.WithCancel(context.Background())
+	kept := make(chan struct{})
+	go func() {
+		defer close(kept)
+		q.keep(keepCtx, queues)
+	}()
+	workers.Start()
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, msg, err := q.Take(queues)
+				if err != nil {
+					log.Printf("queue.error %s", err)
+				}
+				if job == nil {
+					queueWait(ctx)
+					continue
+				}
+				queueHandle(ctx, job, handler)
+				if ctx.Err() != nil {
+					err = q.Release(job, msg)
+				} else {
+					err = q.Complete(job, msg)
+				}
+				if err != nil {
+					log.Printf("queue.error queue=%s job_id=%s %s", job.Queue, job.Id, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stopKeep()
+	<-kept
+	err = q.Unhold()
+	if err != nil {
+		log.Printf("queue.error holder=%s %s", q.Holder, err)
+	}
+	workers.Quit()
+}
+
+func (q *QueueRedis) Depth(ctx context.Context, queue string) (int, error) {
+	return RedisQueueDepth(queue)
+}
+
+// Postgres.
+
+// QueuePg is a queue backed by the jobs table. Workers claim jobs
+// with SELECT ... FOR UPDATE SKIP LOCKED, so that concurrent
+// workers never block on or double-claim the same job. A claim is
+// held for ConfigQueueLockTtl, after which a job whose worker died
+// becomes available again, so claims are renewed while jobs run.
+// Jobs are deleted once handled.
+type QueuePg struct {
+	Holder string
+}
+
+func QueueNewPg() *QueuePg {
+	return &QueuePg{Holder: uuid.New()}
+}
+
+func (q *QueuePg) Enqueue(ctx context.Context, queue string, payload interface{}, at time.Time) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = PgConn.ExecContext(ctx, "INSERT INTO jobs (id, queue, payload, run_at, created_at) VALUES ($1, $2, $3, $4, now())",
+		uuid.New(), queue, string(encoded), at)
+	return err
+}
+
+// Claim takes the next ready job from the first of the named queues
+// that has one, returning nil if none do.
+func (q *QueuePg) Claim(ctx context.Context, queues []string) (*QueueJob, error) {
+	row := PgConn.QueryRowContext(ctx, "UPDATE jobs SET locked_by=$2, locked_until=now() + $3::float8 * interval '1 millisecond' WHERE id = (SELECT id FROM jobs WHERE queue = ANY($1) AND run_at <= now() AND (locked_until IS NULL OR locked_until < now()) ORDER BY array_position($1, queue), run_at LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING id, queue, payload",
+		pq.Array(queues), q.Holder, ConfigQueueLockTtl/time.Millisecond)
+	job := &QueueJob{}
+	var payload string
+	err := row.Scan(&job.Id, &job.Queue, &payload)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	job.Payload = []byte(payload)
+	return job, nil
+}
+
+// Complete deletes a handled job, provided it's still claimed by q.
+func (q *QueuePg) Complete(ctx context.Context, job *QueueJob) error {
+	_, err := PgConn.ExecContext(ctx, "DELETE FROM jobs WHERE id=$1 AND locked_by=$2", job.Id, q.Holder)
+	return err
+}
+
+// Release gives up the claim on a job interrupted by shutdown, so
+// that it's run again without waiting for the claim to expire.
+func (q *QueuePg) Release(ctx context.Context, job *QueueJob) error {
+	_, err := PgConn.ExecContext(ctx, "UPDATE jobs SET locked_by=NULL, locked_until=NULL WHERE id=$1 AND locked_by=$2", job.Id, q.Holder)
+	return err
+}
+
+// Keep renews the claim on job every third of ConfigQueueLockTtl
+// until the returned stop function is called, so that jobs running
+// longer than the TTL aren't claimed again by other workers.
+func (q *QueuePg) Keep(ctx context.Context, job *QueueJob) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ConfigQueueLockTtl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, err := PgConn.ExecContext(ctx, "UPDATE jobs SET locked_until=now() + $3::float8 * interval '1 millisecond' WHERE id=$1 AND locked_by=$2",
+				job.Id, q.Holder, ConfigQueueLockTtl/time.Millisecond)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("queue.error queue=%s job_id=%s %s", job.Queue, job.Id, err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (q *QueuePg) Run(ctx context.Context, queues []string, concurrency int, handler QueueHandler) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, err := q.Claim(ctx, queues)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("queue.error %s", err)
+				}
+				if job == nil {
+					queueWait(ctx)
+					continue
+				}
+				stopKeep := q.Keep(ctx, job)
+				queueHandle(ctx, job, handler)
+				stopKeep()
+				if ctx.Err() != nil {
+					err = q.Release(context.Background(), job)
+				} else {
+					err = q.Complete(context.Background(), job)
+				}
+				if err != nil {
+					log.Printf("queue.error queue=%s job_id=%s %s", job.Queue, job.Id, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *QueuePg) Depth(ctx context.Context, queue string) (int, error) {
+	return PgCount(ctx, "SELECT count(*) FROM jobs WHERE queue=$1 AND run_at <= now() AND (locked_until IS NULL OR locked_until < now())", queue)
+}
+
+// Memory.
+
+// QueueMemory is a queue held in process memory. It's intended for
+// tests, where jobs are enqueued and run within a single process.
+type QueueMemory struct {
+	mu   sync.Mutex
+	jobs []*queueMemoryJob
+}
+
+type queueMemoryJob struct {
+	job *QueueJob
+	at  time.Time
+}
+
+func QueueNewMemory() *QueueMemory {
+	return &QueueMemory{}
+}
+
+func (q *QueueMemory) Enqueue(ctx context.Context, queue string, payload interface{}, at time.Time) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, &queueMemoryJob{
+		job: &QueueJob{Id: uuid.New(), Queue: queue, Payload: encoded},
+		at:  at,
+	})
+	return nil
+}
+
+// Take removes and returns the earliest due ready job on the first
+// of the named queues that has one, returning nil if none do.
+func (q *QueueMemory) Take(queues ...string) *QueueJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, queue := range queues {
+		next := -1
+		for i, j := range q.jobs {
+			if j.job.Queue == queue && !j.at.After(now) && (next == -1 || j.at.Before(q.jobs[next].at)) {
+				next = i
+			}
+		}
+		if next != -1 {
+			job := q.jobs[next].job
+			q.jobs = append(q.jobs[:next], q.jobs[next+1:]...)
+			return job
+		}
+	}
+	return nil
+}
+
+// Jobs returns all jobs on the named queue, including those not yet
+// ready to run, in the order they were enqueued.
+func (q *QueueMemory) Jobs(queue string) []*QueueJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := []*QueueJob{}
+	for _, j := range q.jobs {
+		if j.job.Queue == queue {
+			jobs = append(jobs, j.job)
+		}
+	}
+	return jobs
+}
+
+// Clear removes all jobs from all queues.
+func (q *QueueMemory) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = nil
+}
+
+func (q *QueueMemory) Run(ctx context.Context, queues []string, concurrency int, handler QueueHandler) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job := q.Take(queues...)
+				if job == nil {
+					queueWait(ctx)
+					continue
+				}
+				queueHandle(ctx, job, handler)
+				if ctx.Err() != nil {
+					q.mu.Lock()
+					q.jobs = append(q.jobs, &queueMemoryJob{job: job, at: time.Now()})
+					q.mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *QueueMemory) Depth(ctx context.Context, queue string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	depth := 0
+	for _, j := range q.jobs {
+		if j.job.Queue == queue && !j.at.After(now) {
+			depth++
+		}
+	}
+	return depth, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"github.com/darkhelmet/env"
+	"github.com/jrallison/go-workers"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testRedisOnce sync.Once
+
+// mustQueueRedis returns a QueueRedis on an empty TEST_REDIS_URL
+// database, skipping the test if it's not set.
+func mustQueueRedis(t *testing.T, holder string) *QueueRedis {
+	url := env.StringDefault("TEST_REDIS_URL", "")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL not set")
+	}
+	testRedisOnce.Do(func() {
+		ConfigRedisUrl = url
+		RedisStart()
+	})
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err := conn.Do("flushdb")
+	Must(err)
+	return &QueueRedis{Holder: holder}
+}
+
+func TestQueuePgClaim(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	depth, err := q.Depth(ctx, "pins")
+	Must(err)
+	assert.Equal(t, 1, depth)
+	job, err := q.Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.NotNil(t, job)
+	workerJob, err := WorkerParseJob(job.Payload)
+	Must(err)
+	assert.Equal(t, "pin-1", workerJob.PinId)
+	depth, err = q.Depth(ctx, "pins")
+	Must(err)
+	assert.Equal(t, 0, depth)
+	other, err := QueueNewPg().Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.Nil(t, other)
+	Must(q.Complete(ctx, job))
+	count, err := PgCount(ctx, "SELECT count(*) FROM jobs")
+	Must(err)
+	assert.Equal(t, 0, count)
+}
+
+func TestQueuePgDelayed(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 2}, time.Now().Add(time.Hour)))
+	job, err := q.Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.Nil(t, job)
+	depth, err := q.Depth(ctx, "pins")
+	Must(err)
+	assert.Equal(t, 0, depth)
+}
+
+func TestQueuePgExpiredClaim(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	ConfigQueueLockTtlPrev := ConfigQueueLockTtl
+	ConfigQueueLockTtl = -time.Second
+	defer func() { ConfigQueueLockTtl = ConfigQueueLockTtlPrev }()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	job, err := q.Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.NotNil(t, job)
+	other := QueueNewPg()
+	reclaimed, err := other.Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.NotNil(t, reclaimed)
+	Must(q.Complete(ctx, job))
+	count, err := PgCount(ctx, "SELECT count(*) FROM jobs")
+	Must(err)
+	assert.Equal(t, 1, count)
+}
+
+func TestQueuePgKeep(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	ConfigQueueLockTtlPrev := ConfigQueueLockTtl
+	ConfigQueueLockTtl = 300 * time.Millisecond
+	defer func() { ConfigQueueLockTtl = ConfigQueueLockTtlPrev }()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	job, err := q.Claim(ctx, []string{"pins"})
+	Must(err)
+	stop := q.Keep(ctx, job)
+	time.Sleep(500 * time.Millisecond)
+	other, err := QueueNewPg().Claim(ctx, []string{"pins"})
+	Must(err)
+	assert.Nil(t, other)
+	stop()
+}
+
+func TestQueuePgRunReleasesOnShutdown(t *testing.T) {
+	defer clear()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	q.Run(ctx, []string{"pins"}, 1, func(ctx context.Context, job *QueueJob) {
+		cancel()
+	})
+	depth, err := q.Depth(context.Background(), "pins")
+	Must(err)
+	assert.Equal(t, 1, depth)
+}
+
+func TestQueuePgPriority(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	q := QueueNewPg()
+	Must(q.Enqueue(ctx, "pins.scheduled", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now().Add(-time.Minute)))
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-2", Attempt: 1}, time.Now()))
+	job, err := q.Claim(ctx, []string{"pins.interactive", "pins.scheduled"})
+	Must(err)
+	assert.Equal(t, "pins.interactive", job.Queue)
+	job, err = q.Claim(ctx, []string{"pins.interactive", "pins.scheduled"})
+	Must(err)
+	assert.Equal(t, "pins.scheduled", job.Queue)
+}
+
+func TestQueueRedisTake(t *testing.T) {
+	ctx := context.Background()
+	q := mustQueueRedis(t, "holder-1")
+	Must(q.Enqueue(ctx, "pins.scheduled", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-2", Attempt: 1}, time.Now()))
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-3", Attempt: 1}, time.Now().Add(time.Hour)))
+	depth, err := q.Depth(ctx, "pins.interactive")
+	Must(err)
+	assert.Equal(t, 1, depth)
+	job, msg, err := q.Take([]string{"pins.interactive", "pins.scheduled"})
+	Must(err)
+	workerJob, err := WorkerParseJob(job.Payload)
+	Must(err)
+	assert.Equal(t, "pin-2", workerJob.PinId)
+	Must(q.Complete(job, msg))
+	job, msg, err = q.Take([]string{"pins.interactive", "pins.scheduled"})
+	Must(err)
+	assert.Equal(t, "pins.scheduled", job.Queue)
+	Must(q.Release(job, msg))
+	depth, err = q.Depth(ctx, "pins.scheduled")
+	Must(err)
+	assert.Equal(t, 1, depth)
+	job, msg, err = q.Take([]string{"pins.scheduled"})
+	Must(err)
+	Must(q.Complete(job, msg))
+	job, _, err = q.Take([]string{"pins.interactive", "pins.scheduled"})
+	Must(err)
+	assert.Nil(t, job)
+}
+
+func TestQueueRedisRecover(t *testing.T) {
+	ctx := context.Background()
+	ConfigQueueLockTtlPrev := ConfigQueueLockTtl
+	ConfigQueueLockTtl = 100 * time.Millisecond
+	defer func() { ConfigQueueLockTtl = ConfigQueueLockTtlPrev }()
+	crashed := mustQueueRedis(t, "holder-1")
+	live := &QueueRedis{Holder: "holder-2"}
+	Must(crashed.Enqueue(ctx, "pins", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	Must(crashed.Hold())
+	job, _, err := crashed.Take([]string{"pins"})
+	Must(err)
+	assert.NotNil(t, job)
+	Must(live.Hold())
+	Must(live.Recover([]string{"pins"}))
+	depth, err := live.Depth(ctx, "pins")
+	Must(err)
+	assert.Equal(t, 0, depth)
+	time.Sleep(200 * time.Millisecond)
+	Must(live.Hold())
+	Must(live.Recover([]string{"pins"}))
+	depth, err = live.Depth(ctx, "pins")
+	Must(err)
+	assert.Equal(t, 1, depth)
+}
+
+func TestQueueMemoryPriority(t *testing.T) {
+	ctx := context.Background()
+	q := QueueNewMemory()
+	Must(q.Enqueue(ctx, "pins.scheduled", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now().Add(-time.Minute)))
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-2", Attempt: 1}, time.Now()))
+	assert.Equal(t, "pins.interactive", q.Take("pins.interactive", "pins.scheduled").Queue)
+	assert.Equal(t, "pins.scheduled", q.Take("pins.interactive", "pins.scheduled").Queue)
+	assert.Nil(t, q.Take("pins.interactive", "pins.scheduled"))
+}
+
+func TestQueueRunRecovers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := QueueNewMemory()
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-1", Attempt: 1}, time.Now()))
+	Must(q.Enqueue(ctx, "pins.interactive", &WorkerJob{PinId: "pin-2", Attempt: 1}, time.Now()))
+	handled := 0
+	q.Run(ctx, []string{"pins.interactive"}, 1, func(ctx context.Context, job *QueueJob) {
+		handled++
+		if handled == 1 {
+			panic("bad job")
+		}
+		cancel()
+	})
+	assert.Equal(t, 2, handled)
+}
+
+func TestWorkerParseJobLegacy(t *testing.T) {
+	job, err := WorkerParseJob([]byte(`"pin-1"`))
+	Must(err)
+	assert.Equal(t, "pin-1", job.PinId)
+	assert.Equal(t, 1, job.Attempt)
+	assert.Equal(t, WorkerPriorityScheduled, job.Priority)
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"github.com/jrallison/go-workers"
 	"log"
 	"net/url"
 	"strings"
+	"time"
 )
 
 func RedisStart() {
@@ -27,3 +30,39 @@ func RedisStart() {
 	})
 	workers.Middleware = workers.NewMiddleware()
 }
+
+func RedisPing() error {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err := conn.Do("ping")
+	return err
+}
+
+// RedisQueueDepth returns the number of jobs waiting on the given
+// go-workers queue.
+func RedisQueueDepth(queue string) (int, error) {
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	return redis.Int(conn.Do("llen", "queue:"+queue))
+}
+
+// RedisEnqueueAt enqueues a job with the given args onto the named
+// go-workers queue, to be run no earlier than at. The job is held
+// in the go-workers schedule until then.
+func RedisEnqueueAt(queue string, args interface{}, at time.Time) error {
+	data := workers.EnqueueData{
+		Queue:      queue,
+		Class:      "",
+		Args:       args,
+		Jid:        strings.Replace(uuid.New(), "-", "", -1),
+		EnqueuedAt: float64(time.Now().UnixNano()) / 1000000000,
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	conn := workers.Config.Pool.Get()
+	defer func() { Must(conn.Close()) }()
+	_, err = conn.Do("zadd", "schedule", at.Unix(), encoded)
+	return err
+}
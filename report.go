@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events.
+
+// ReportEvent is an error or panic sent to the exception reporting
+// sink. Its JSON form follows the Sentry event protocol, so the same
+// payload is written by all sinks.
+type ReportEvent struct {
+	EventId   string            `json:"event_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Logger    string            `json:"logger"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Exception *ReportException  `json:"exception,omitempty"`
+}
+
+type ReportException struct {
+	Values []*ReportExceptionValue `json:"values"`
+}
+
+type ReportExceptionValue struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *ReportStacktrace `json:"stacktrace,omitempty"`
+}
+
+type ReportStacktrace struct {
+	Frames []*ReportFrame `json:"frames"`
+}
+
+type ReportFrame struct {
+	Filename string `json:"filename"`
+	Function string `json:"function"`
+	Lineno   int    `json:"lineno"`
+}
+
+// ReportNewEvent builds an event for the given error type and
+// message, with a stack trace of the caller skip frames up.
+func ReportNewEvent(logger string, level string, errType string, message string, tags map[string]string, skip int) *ReportEvent {
+	return &ReportEvent{
+		EventId:   strings.Replace(uuid.New(), "-", "", -1),
+		Timestamp: time.Now().UTC(),
+		Level:     level,
+		Platform:  "go",
+		Logger:    logger,
+		Message:   message,
+		Tags:      tags,
+		Exception: &ReportException{
+			Values: []*ReportExceptionValue{{
+				Type:       errType,
+				Value:      message,
+				Stacktrace: ReportStack(skip + 1),
+			}},
+		},
+	}
+}
+
+// ReportStack returns the stack trace of the caller skip frames
+// up, ordered oldest call first as Sentry expects.
+func ReportStack(skip int) *ReportStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	stack := &ReportStacktrace{}
+	for {
+		frame, more := frames.Next()
+		stack.Frames = append([]*ReportFrame{{
+			Filename: frame.File,
+			Function: frame.Function,
+			Lineno:   frame.Line,
+		}}, stack.Frames...)
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+// Sinks.
+
+// Reporter is implemented by exception reporting sinks.
+type Reporter interface {
+	Report(event *ReportEvent) error
+}
+
+// ReportSentrySink sends events to a Sentry-protocol-compatible
+// HTTP endpoint, as identified by a DSN of the form
+// https://<key>@<host>/<project>.
+type ReportSentrySink struct {
+	Endpoint  string
+	PublicKey string
+	Client    *http.Client
+}
+
+func ReportNewSentrySink(dsn string) (*ReportSentrySink, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("report: sentry dsn missing public key")
+	}
+	projectId := path.Base(u.Path)
+	if projectId == "/" || projectId == "." {
+		return nil, errors.New("report: sentry dsn missing project id")
+	}
+	prefix := strings.TrimSuffix(path.Dir(u.Path), "/")
+	return &ReportSentrySink{
+		Endpoint:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, projectId),
+		PublicKey: u.User.Username(),
+		Client:    &http.Client{Timeout: ConfigReportTimeout},
+	}, nil
+}
+
+func (s *ReportSentrySink) Report(event *ReportEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=pgpin/1.0, sentry_timestamp=%d, sentry_key=%s",
+		event.Timestamp.Unix(), s.PublicKey))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { Must(resp.Body.Close()) }()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("report: sentry responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReportFileSink appends events to the file at Path, one JSON
+// object per line. It's intended for tests and development.
+type ReportFileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *ReportFileSink) Report(event *ReportEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		Must(f.Close())
+		return err
+	}
+	return f.Close()
+}
+
+// Reporting.
+
+// ReportSink is the sink for reported errors and panics, or nil if
+// exception reporting isn't configured.
+var ReportSink Reporter
+
+// ReportStart configures ReportSink according to the environment.
+func ReportStart() {
+	log.Print("report.start")
+	switch {
+	case ConfigReportSentryDsn != "":
+		sink, err := ReportNewSentrySink(ConfigReportSentryDsn)
+		Must(err)
+		ReportSink = sink
+	case ConfigReportFile != "":
+		ReportSink = &ReportFileSink{Path: ConfigReportFile}
+	}
+}
+
+// Events are sent to the sink in the background, so that slow
+// reporting doesn't hold up the requests and jobs reporting them.
+// At most ConfigReportQueueSize events wait to be sent, with any
+// further events dropped.
+
+type reportItem struct {
+	Sink    Reporter
+	Event   *ReportEvent
+	Flushed chan struct{}
+}
+
+var (
+	reportQueue = make(chan *reportItem, ConfigReportQueueSize)
+	reportOnce  sync.Once
+)
+
+// ReportSend queues event to be sent to ReportSink, if configured.
+func ReportSend(event *ReportEvent) {
+	if ReportSink == nil {
+		return
+	}
+	reportOnce.Do(func() { go reportLoop() })
+	select {
+	case reportQueue <- &reportItem{Sink: ReportSink, Event: event}:
+	default:
+		log.Printf("report.drop event_id=%s", event.EventId)
+	}
+}
+
+// ReportFlush waits for the events queued so far to be sent, for at
+// most ConfigReportTimeout.
+func ReportFlush() {
+	reportOnce.Do(func() { go reportLoop() })
+	flushed := make(chan struct{})
+	timeout := time.After(ConfigReportTimeout)
+	select {
+	case reportQueue <- &reportItem{Flushed: flushed}:
+	case <-timeout:
+		log.Printf("report.flush.timeout")
+		return
+	}
+	select {
+	case <-flushed:
+	case <-timeout:
+		log.Printf("report.flush.timeout")
+	}
+}
+
+func reportLoop() {
+	for item := range reportQueue {
+		if item.Flushed != nil {
+			close(item.Flushed)
+			continue
+		}
+		err := item.Sink.Report(item.Event)
+		if err != nil {
+			log.Printf("report.error event_id=%s %s", item.Event.EventId, err)
+		}
+	}
+}
+
+// ReportError reports err, tagged with the given request, pin, job
+// and similar ids.
+func ReportError(logger string, err error, tags map[string]string) {
+	errType := reflect.TypeOf(err).String()
+	ReportSend(ReportNewEvent(logger, "error", errType, err.Error(), tags, 1))
+}
+
+// ReportPanic reports the recovered panic value. It should be
+// called from the deferred function that recovered, so that the
+// stack trace includes the panicking frames.
+func ReportPanic(logger string, recovered interface{}, tags map[string]string) {
+	message := fmt.Sprint(recovered)
+	ReportSend(ReportNewEvent(logger, "fatal", "panic", message, tags, 1))
+}
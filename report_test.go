@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustReportFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pgpin-report")
+	Must(err)
+	path := filepath.Join(dir, "events.json")
+	ReportSinkPrev := ReportSink
+	ReportSink = &ReportFileSink{Path: path}
+	return path, func() {
+		ReportSink = ReportSinkPrev
+		Must(os.RemoveAll(dir))
+	}
+}
+
+func mustReadEvents(path string) []*ReportEvent {
+	ReportFlush()
+	f, err := os.Open(path)
+	Must(err)
+	defer func() { Must(f.Close()) }()
+	events := []*ReportEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &ReportEvent{}
+		Must(json.Unmarshal(scanner.Bytes(), event))
+		events = append(events, event)
+	}
+	Must(scanner.Err())
+	return events
+}
+
+func TestReportError(t *testing.T) {
+	path, restore := mustReportFile(t)
+	defer restore()
+	req, err := http.NewRequest("GET", "/error", nil)
+	Must(err)
+	req.Header.Set("Request-Id", "given")
+	res := httptest.NewRecorder()
+	WebMux.ServeHTTP(res, req)
+	assert.Equal(t, 500, res.Code)
+	events := mustReadEvents(path)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "error", events[0].Level)
+	assert.Equal(t, "a problem occurred", events[0].Message)
+	assert.Equal(t, "given", events[0].Tags["request_id"])
+	assert.NotEmpty(t, events[0].Exception.Values[0].Stacktrace.Frames)
+}
+
+func TestReportPanic(t *testing.T) {
+	path, restore := mustReportFile(t)
+	defer restore()
+	req, err := http.NewRequest("GET", "/panic", nil)
+	Must(err)
+	req.Header.Set("Request-Id", "given")
+	res := httptest.NewRecorder()
+	WebMux.ServeHTTP(res, req)
+	assert.Equal(t, 500, res.Code)
+	events := mustReadEvents(path)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "fatal", events[0].Level)
+	assert.Equal(t, "panic", events[0].Message)
+	assert.Equal(t, "given", events[0].Tags["request_id"])
+	functions := []string{}
+	for _, frame := range events[0].Exception.Values[0].Stacktrace.Frames {
+		functions = append(functions, frame.Function)
+	}
+	assert.Contains(t, strings.Join(functions, " "), "main.WebTriggerPanic")
+}
+
+func TestReportWorkerError(t *testing.T) {
+	defer clear()
+	path, restore := mustReportFile(t)
+	defer restore()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	_, err := PgConn.Exec("UPDATE dbs SET deleted_at=now() WHERE id=$1", dbIn.Id)
+	Must(err)
+	payload := []byte(`{"pin_id": "` + pinIn.Id + `", "request_id": "given"}`)
+	WorkerProcessWrapper(context.Background(), &QueueJob{Id: "job-1", Queue: "pins", Payload: payload})
+	events := mustReadEvents(path)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "worker", events[0].Logger)
+	assert.Equal(t, "pgpin: db-not-found: db not found", events[0].Message)
+	assert.Equal(t, "given", events[0].Tags["request_id"])
+	assert.Equal(t, "job-1", events[0].Tags["job_id"])
+	assert.Equal(t, pinIn.Id, events[0].Tags["pin_id"])
+}
+
+func TestReportSentrySink(t *testing.T) {
+	var auth string
+	event := &ReportEvent{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/sentry/api/42/store/", req.URL.Path)
+		auth = req.Header.Get("X-Sentry-Auth")
+		Must(json.NewDecoder(req.Body).Decode(event))
+	}))
+	defer server.Close()
+	dsn := strings.Replace(server.URL, "http://", "http://public@", 1) + "/sentry/42"
+	sink, err := ReportNewSentrySink(dsn)
+	Must(err)
+	err = sink.Report(ReportNewEvent("web", "error", "*errors.errorString", "a problem occurred", nil, 0))
+	assert.Nil(t, err)
+	assert.Contains(t, auth, "sentry_key=public")
+	assert.Equal(t, "a problem occurred", event.Message)
+	assert.Equal(t, 32, len(event.EventId))
+}
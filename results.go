@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Pin results are stored outside the pins table as gzipped NDJSON.
+// Each result set is written as a line holding the set's JSON
+// object without its rows, followed by a line per row holding the
+// row's JSON array.
+
+// ResultsEncode encodes sets for storage.
+func ResultsEncode(sets []*PinResultsSet) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gz)
+	for _, set := range sets {
+		header := *set
+		header.Rows = nil
+		err := enc.Encode(&header)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range set.Rows {
+			err := enc.Encode(row)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ResultsReader reads results encoded with ResultsEncode a line at
+// a time, so that they can be streamed without holding them in
+// memory.
+type ResultsReader struct {
+	gz    *gzip.Reader
+	dec   *json.Decoder
+	inSet bool
+}
+
+func ResultsNewReader(r io.Reader) (*ResultsReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultsReader{gz: gz, dec: json.NewDecoder(gz)}, nil
+}
+
+// Next returns the next line of the results: either the next result
+// set, without its rows, or a row of the current set as raw JSON
+// values. It returns io.EOF after the last line.
+func (r *ResultsReader) Next() (*PinResultsSet, []json.RawMessage, error) {
+	line := json.RawMessage{}
+	err := r.dec.Decode(&line)
+	if err == io.EOF {
+		err = r.gz.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, io.EOF
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch line[0] {
+	case '{':
+		set := &PinResultsSet{}
+		err = json.Unmarshal(line, set)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.inSet = set.Error == nil
+		return set, nil, nil
+	case '[':
+		if !r.inSet {
+			return nil, nil, fmt.Errorf("results: row without a result set")
+		}
+		row := []json.RawMessage{}
+		err = json.Unmarshal(line, &row)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, row, nil
+	default:
+		return nil, nil, fmt.Errorf("results: unexpected line %s", line)
+	}
+}
+
+// ResultsDecode decodes sets encoded with ResultsEncode. Row values
+// are returned as json.RawMessages, so that they're re-encoded
+// exactly as stored.
+func ResultsDecode(r io.Reader) ([]*PinResultsSet, error) {
+	reader, err := ResultsNewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	sets := []*PinResultsSet{}
+	for {
+		set, row, err := reader.Next()
+		if err == io.EOF {
+			return sets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if set != nil {
+			if set.Error == nil {
+				set.Rows = [][]interface{}{}
+			}
+			sets = append(sets, set)
+			continue
+		}
+		values := make([]interface{}, len(row))
+		for i, value := range row {
+			values[i] = value
+		}
+		last := sets[len(sets)-1]
+		last.Rows = append(last.Rows, values)
+	}
+}
+
+// ResultsHeaders returns the result sets encoded with
+// ResultsEncode, without their rows.
+func ResultsHeaders(r io.Reader) ([]*PinResultsSet, error) {
+	reader, err := ResultsNewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	sets := []*PinResultsSet{}
+	for {
+		set, _, err := reader.Next()
+		if err == io.EOF {
+			return sets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if set != nil {
+			sets = append(sets, set)
+		}
+	}
+}
+
+// resultsJsonSet is a result set as written by ResultsWriteJson,
+// before its rows.
+type resultsJsonSet struct {
+	Fields    []string            `json:"fields"`
+	Columns   []*PinResultsColumn `json:"columns"`
+	Truncated bool                `json:"truncated"`
+	RowCount  int                 `json:"row_count"`
+	Error     *string             `json:"error"`
+}
+
+// ResultsWriteJson writes the results read from r to w as a JSON
+// array of result sets, in the form of a pin's results_sets.
+func ResultsWriteJson(w io.Writer, r *ResultsReader) error {
+	sets, rows := 0, 0
+	inRows := false
+	out := []byte{}
+	for {
+		set, row, err := r.Next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		done := err == io.EOF
+		out = out[:0]
+		if inRows && row == nil {
+			out = append(out, "]}"...)
+			inRows = false
+		}
+		switch {
+		case done:
+			if sets == 0 {
+				out = append(out, '[')
+			}
+			out = append(out, "]\n"...)
+		case set != nil:
+			if sets == 0 {
+				out = append(out, '[')
+			} else {
+				out = append(out, ',')
+			}
+			sets++
+			header, err := json.Marshal(&resultsJsonSet{
+				Fields:    set.Fields,
+				Columns:   set.Columns,
+				Truncated: set.Truncated,
+				RowCount:  set.RowCount,
+				Error:     set.Error,
+			})
+			if err != nil {
+				return err
+			}
+			out = append(out, bytes.TrimSuffix(header, []byte("}"))...)
+			if set.Error == nil {
+				out = append(out, `,"rows":[`...)
+				inRows = true
+				rows = 0
+			} else {
+				out = append(out, `,"rows":null}`...)
+			}
+		default:
+			if rows > 0 {
+				out = append(out, ',')
+			}
+			rows++
+			rowJson, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			out = append(out, rowJson...)
+		}
+		_, err = w.Write(out)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// ResultsWriteNdjson writes the results read from r to w in the
+// NDJSON form they're stored in.
+func ResultsWriteNdjson(w io.Writer, r *ResultsReader) error {
+	_, err := io.Copy(w, r.gz)
+	return err
+}
+
+// ResultsWriteCsv writes the rows of the result set with the given
+// index read from r to w as CSV, with a header line of the set's
+// fields. String values are written unquoted, nulls as empty
+// fields, and other values as JSON.
+func ResultsWriteCsv(w io.Writer, r *ResultsReader, index int) error {
+	cw := csv.NewWriter(w)
+	current := -1
+	for {
+		set, row, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if set != nil {
+			current++
+			if current == index {
+				err = cw.Write(set.Fields)
+			}
+		} else if current == index {
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = resultsCsvValue(value)
+			}
+			err = cw.Write(record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func resultsCsvValue(value json.RawMessage) string {
+	if string(value) == "null" {
+		return ""
+	}
+	s := ""
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	return string(value)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestResultsEncodeDecode(t *testing.T) {
+	message := "column \"wat\" does not exist"
+	setsIn := []*PinResultsSet{
+		{Fields: []string{"a", "b"}, Columns: []*PinResultsColumn{}, Rows: [][]interface{}{{json.Number("1"), "x"}, {json.RawMessage(`{"k": [1.50]}`), nil}}, RowCount: 2},
+		{Error: &message},
+		{Fields: []string{}, Columns: []*PinResultsColumn{}, Rows: [][]interface{}{}, Truncated: true, RowCount: 1},
+	}
+	data, err := ResultsEncode(setsIn)
+	Must(err)
+	setsOut, err := ResultsDecode(bytes.NewReader(data))
+	Must(err)
+	assert.Equal(t, string(MustNewPgJson(setsIn)), string(MustNewPgJson(setsOut)))
+	_, err = ResultsDecode(bytes.NewReader([]byte("not gzip")))
+	assert.NotNil(t, err)
+}
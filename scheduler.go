@@ -1,49 +1,165 @@
 package main
 
 import (
-	"github.com/jrallison/go-workers"
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"fmt"
 	"log"
 	"time"
 )
 
-func SchedulerEnqueue(pin *Pin) error {
-	log.Printf("scheduler.enqueue pin_id=%s", pin.Id)
-	pin.ScheduledAt = time.Now()
-	err := PinUpdate(pin)
+// SchedulerClaim claims up to ConfigSchedulerBatchSize pins last
+// scheduled no later than cutoff, returning the number claimed.
+// Claiming a pin resets its scheduled_at and records it in the
+// outbox in a single statement, so that a claimed refresh is never
+// lost: the outbox is flushed to the queue by SchedulerFlush, and
+// anything left in it by a failed flush or crash is flushed on the
+// next tick. Pins already in the outbox are claimed but not added
+// again, so claims are counted from the claimed pins rather than
+// the outbox inserts.
+func SchedulerClaim(ctx context.Context, cutoff time.Time) (int, error) {
+	return PgCount(ctx, "WITH claimed AS (UPDATE pins SET scheduled_at=now() WHERE id IN (SELECT id FROM pins WHERE deleted_at IS NULL AND scheduled_at <= $1 ORDER BY scheduled_at LIMIT $2 FOR UPDATE SKIP LOCKED) RETURNING id), outboxed AS (INSERT INTO scheduler_outbox (pin_id, request_id, created_at) SELECT id, $3, now() FROM claimed ON CONFLICT (pin_id) DO NOTHING) SELECT count(*) FROM claimed",
+		cutoff, ConfigSchedulerBatchSize, ContextRequestId(ctx))
+}
+
+// SchedulerFlush enqueues runs for pins in the outbox, removing each
+// from the outbox once enqueued. A failure to enqueue one pin is
+// logged and doesn't prevent the others being enqueued; the number
+// of failures is returned.
+func SchedulerFlush(ctx context.Context) (int, error) {
+	res, err := PgConn.QueryContext(ctx, "SELECT pin_id, request_id FROM scheduler_outbox ORDER BY created_at LIMIT $1", ConfigSchedulerBatchSize)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	err = workers.Enqueue("pins", "", pin.Id)
+	defer func() { Must(res.Close()) }()
+	type entry struct{ pinId, requestId string }
+	entries := []entry{}
+	for res.Next() {
+		e := entry{}
+		err := res.Scan(&e.pinId, &e.requestId)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	err = res.Err()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	failed := 0
+	for _, e := range entries {
+		entryCtx := ContextWithRequestId(ctx, e.requestId)
+		err := WorkerEnqueue(entryCtx, e.pinId, WorkerPriorityScheduled)
+		if err == nil {
+			_, err = PgConn.ExecContext(ctx, "DELETE FROM scheduler_outbox WHERE pin_id=$1", e.pinId)
+		}
+		if err != nil {
+			log.Printf("scheduler.enqueue.error request_id=%s pin_id=%s %s", e.requestId, e.pinId, err)
+			failed++
+			continue
+		}
+		log.Printf("scheduler.enqueue request_id=%s pin_id=%s", e.requestId, e.pinId)
+	}
+	return failed, nil
 }
 
-func SchedulerTick() error {
-	log.Printf("scheduler.tick")
-	ready, err := PinList("scheduled_at <= $1", time.Now().Add(-ConfigPinRefreshInterval))
+// SchedulerTick enqueues runs of all pins due for a refresh, in
+// batches of ConfigSchedulerBatchSize. Each tick gets its own
+// request id so that the resulting pin runs can be traced back to
+// it. The tick is recorded only if every claimed pin was enqueued.
+//
+// The cutoff for pins due is fixed at the start of the tick, by the
+// Postgres clock, so that pins claimed by the tick are never due
+// again within it.
+func SchedulerTick(ctx context.Context) error {
+	ctx = ContextWithRequestId(ctx, uuid.New())
+	log.Printf("scheduler.tick request_id=%s", ContextRequestId(ctx))
+	var startedAt time.Time
+	err := PgConn.QueryRowContext(ctx, "SELECT now()").Scan(&startedAt)
 	if err != nil {
 		return err
 	}
-	for _, pin := range ready {
-		err = SchedulerEnqueue(pin)
+	cutoff := startedAt.Add(-ConfigPinRefreshInterval)
+	failed := 0
+	for {
+		claimed, err := SchedulerClaim(ctx, cutoff)
+		if err != nil {
+			return err
+		}
+		batchFailed, err := SchedulerFlush(ctx)
 		if err != nil {
 			return err
 		}
+		failed += batchFailed
+		if claimed < ConfigSchedulerBatchSize || batchFailed > 0 {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("scheduler: %d pin enqueues failed", failed)
 	}
-	return nil
+	_, err = PgConn.ExecContext(ctx, "UPDATE scheduler_state SET ticked_at=$1", time.Now())
+	return err
+}
+
+// SchedulerTickedAt returns the time at which a scheduler last
+// completed a tick, or nil if none ever has.
+func SchedulerTickedAt(ctx context.Context) (*time.Time, error) {
+	row := PgConn.QueryRowContext(ctx, "SELECT ticked_at FROM scheduler_state")
+	var tickedAt *time.Time
+	err := row.Scan(&tickedAt)
+	if err != nil {
+		return nil, err
+	}
+	return tickedAt, nil
+}
+
+// SchedulerLead takes or extends the scheduler leadership lease for
+// holder, and ticks if holder is the leader. Any number of
+// scheduler processes may run, but only the leader ticks. If the
+// leader stops, its lease expires after ConfigSchedulerLeaseTtl
+// and another scheduler takes over. The lease is kept while ticking,
+// so that a slow tick doesn't let another scheduler tick alongside.
+func SchedulerLead(ctx context.Context, holder string) (bool, error) {
+	leading, err := LeaseAcquire(ctx, "scheduler", holder, ConfigSchedulerLeaseTtl)
+	if err != nil || !leading {
+		return false, err
+	}
+	ctx, stopKeep := LeaseKeep(ctx, "scheduler", holder, ConfigSchedulerLeaseTtl)
+	defer stopKeep()
+	return true, SchedulerTick(ctx)
 }
 
 func SchedulerStart() {
 	log.Printf("scheduler.start")
+	ReportStart()
 	PgStart()
-	RedisStart()
+	QueueStart()
+	ctx := ContextShutdown()
+	holder := uuid.New()
+	wasLeading := false
 	for {
-		err := SchedulerTick()
+		leading, err := SchedulerLead(ctx, holder)
 		if err != nil {
 			log.Printf("scheduler.error %+s", err.Error())
 		}
-		time.Sleep(ConfigSchedulerTickInterval)
+		if leading != wasLeading {
+			if leading {
+				log.Printf("scheduler.lead holder=%s", holder)
+			} else {
+				log.Printf("scheduler.standby holder=%s", holder)
+			}
+			wasLeading = leading
+		}
+		select {
+		case <-ctx.Done():
+			err := LeaseRelease(context.Background(), "scheduler", holder)
+			if err != nil {
+				log.Printf("scheduler.error %+s", err.Error())
+			}
+			log.Printf("scheduler.exit")
+			return
+		case <-time.After(ConfigSchedulerTickInterval):
+		}
 	}
 }
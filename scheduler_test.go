@@ -1,10 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
+// failingQueue is a queue that can't be enqueued to.
+type failingQueue struct {
+	*QueueMemory
+}
+
+func (q *failingQueue) Enqueue(ctx context.Context, queue string, payload interface{}, at time.Time) error {
+	return errors.New("queue unavailable")
+}
+
 func TestSchedulerNoEnqueues(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
@@ -33,3 +45,127 @@ func TestSchedulerEnqueue(t *testing.T) {
 	pinOut2 := mustPinGet(pinIn.Id)
 	assert.NotEqual(t, pinOut1.Version, pinOut2.Version)
 }
+
+func TestSchedulerInteractiveFirst(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	mustPinCreate(dbIn.Id, "pins-1", "select now()")
+	mustWorkerTick()
+	ConfigPinRefreshIntervalPrev := ConfigPinRefreshInterval
+	defer func() {
+		ConfigPinRefreshInterval = ConfigPinRefreshIntervalPrev
+	}()
+	ConfigPinRefreshInterval = 0
+	mustSchedulerTick()
+	pinIn2 := mustPinCreate(dbIn.Id, "pins-2", "select now()")
+	assert.Equal(t, 1, len(testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))))
+	mustWorkerTick()
+	assert.NotNil(t, mustPinGet(pinIn2.Id).QueryFinishedAt)
+	assert.Equal(t, 1, len(testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))))
+	mustWorkerTick()
+	assert.Equal(t, 0, len(testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))))
+}
+
+func TestSchedulerLeader(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	leading, err := SchedulerLead(ctx, "scheduler-1")
+	Must(err)
+	assert.True(t, leading)
+	leading, err = SchedulerLead(ctx, "scheduler-2")
+	Must(err)
+	assert.False(t, leading)
+	leading, err = SchedulerLead(ctx, "scheduler-1")
+	Must(err)
+	assert.True(t, leading)
+	Must(LeaseRelease(ctx, "scheduler", "scheduler-1"))
+	leading, err = SchedulerLead(ctx, "scheduler-2")
+	Must(err)
+	assert.True(t, leading)
+}
+
+func TestSchedulerLeaderFailover(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	ConfigSchedulerLeaseTtlPrev := ConfigSchedulerLeaseTtl
+	defer func() {
+		ConfigSchedulerLeaseTtl = ConfigSchedulerLeaseTtlPrev
+	}()
+	ConfigSchedulerLeaseTtl = 100 * time.Millisecond
+	leading, err := SchedulerLead(ctx, "scheduler-1")
+	Must(err)
+	assert.True(t, leading)
+	time.Sleep(200 * time.Millisecond)
+	leading, err = SchedulerLead(ctx, "scheduler-2")
+	Must(err)
+	assert.True(t, leading)
+}
+
+func TestSchedulerBatches(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	mustPinCreate(dbIn.Id, "pins-1", "select now()")
+	mustPinCreate(dbIn.Id, "pins-2", "select now()")
+	mustPinCreate(dbIn.Id, "pins-3", "select now()")
+	testQueue.Clear()
+	ConfigPinRefreshIntervalPrev := ConfigPinRefreshInterval
+	ConfigSchedulerBatchSizePrev := ConfigSchedulerBatchSize
+	defer func() {
+		ConfigPinRefreshInterval = ConfigPinRefreshIntervalPrev
+		ConfigSchedulerBatchSize = ConfigSchedulerBatchSizePrev
+	}()
+	ConfigPinRefreshInterval = 0
+	ConfigSchedulerBatchSize = 2
+	mustSchedulerTick()
+	assert.Equal(t, 3, len(testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))))
+	ConfigPinRefreshInterval = time.Hour
+	mustSchedulerTick()
+	assert.Equal(t, 3, len(testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))))
+}
+
+func TestSchedulerOutbox(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select now()")
+	testQueue.Clear()
+	ConfigPinRefreshIntervalPrev := ConfigPinRefreshInterval
+	defer func() {
+		ConfigPinRefreshInterval = ConfigPinRefreshIntervalPrev
+		QueueBackend = testQueue
+	}()
+	ConfigPinRefreshInterval = 0
+	QueueBackend = &failingQueue{testQueue}
+	err := SchedulerTick(ctx)
+	assert.NotNil(t, err)
+	pending, err := PgCount(ctx, "SELECT count(*) FROM scheduler_outbox WHERE pin_id=$1", pinIn.Id)
+	Must(err)
+	assert.Equal(t, 1, pending)
+	ConfigPinRefreshInterval = time.Hour
+	QueueBackend = testQueue
+	mustSchedulerTick()
+	jobs := testQueue.Jobs(WorkerQueue(WorkerPriorityScheduled))
+	assert.Equal(t, 1, len(jobs))
+	job, err := WorkerParseJob(jobs[0].Payload)
+	Must(err)
+	assert.Equal(t, pinIn.Id, job.PinId)
+	pending, err = PgCount(ctx, "SELECT count(*) FROM scheduler_outbox")
+	Must(err)
+	assert.Equal(t, 0, pending)
+}
+
+func TestSchedulerClaimCountsOutboxedPins(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select now()")
+	mustPinCreate(dbIn.Id, "pins-2", "select now()")
+	_, err := PgConn.ExecContext(ctx, "INSERT INTO scheduler_outbox (pin_id, request_id, created_at) VALUES ($1, 'given', now())", pinIn.Id)
+	Must(err)
+	claimed, err := SchedulerClaim(ctx, time.Now())
+	Must(err)
+	assert.Equal(t, 2, claimed)
+	pending, err := PgCount(ctx, "SELECT count(*) FROM scheduler_outbox")
+	Must(err)
+	assert.Equal(t, 2, pending)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StatusCheck is the result of checking one component of the
+// system. Value is a measurement specific to the check, such as
+// a queue depth or an age in seconds.
+type StatusCheck struct {
+	Status  string   `json:"status"`
+	Value   *float64 `json:"value,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+type Status struct {
+	Message string                  `json:"message"`
+	Checks  map[string]*StatusCheck `json:"checks,omitempty"`
+}
+
+func statusOk(value *float64) *StatusCheck {
+	return &StatusCheck{Status: "ok", Value: value}
+}
+
+func statusDegraded(value *float64, format string, args ...interface{}) *StatusCheck {
+	return &StatusCheck{Status: "degraded", Value: value, Message: fmt.Sprintf(format, args...)}
+}
+
+func statusThreshold(value float64, max float64, format string) *StatusCheck {
+	if value > max {
+		return statusDegraded(&value, format, value, max)
+	}
+	return statusOk(&value)
+}
+
+func StatusCheckPostgres(ctx context.Context) *StatusCheck {
+	err := PgConn.PingContext(ctx)
+	if err != nil {
+		return statusDegraded(nil, "%s", err)
+	}
+	return statusOk(nil)
+}
+
+func StatusCheckRedis(ctx context.Context) *StatusCheck {
+	err := RedisPing()
+	if err != nil {
+		return statusDegraded(nil, "%s", err)
+	}
+	return statusOk(nil)
+}
+
+// StatusCheckQueue checks the number of pin jobs, across all
+// priorities, waiting to be picked up by a worker.
+func StatusCheckQueue(ctx context.Context) *StatusCheck {
+	depth := 0
+	for _, queue := range WorkerQueues {
+		queueDepth, err := QueueBackend.Depth(ctx, queue)
+		if err != nil {
+			return statusDegraded(nil, "%s", err)
+		}
+		depth += queueDepth
+	}
+	return statusThreshold(float64(depth), float64(ConfigStatusQueueDepthMax),
+		"queue depth %.0f exceeds %.0f")
+}
+
+// StatusCheckScheduler checks the number of seconds since the
+// scheduler last completed a tick.
+func StatusCheckScheduler(ctx context.Context) *StatusCheck {
+	tickedAt, err := SchedulerTickedAt(ctx)
+	if err != nil {
+		return statusDegraded(nil, "%s", err)
+	}
+	if tickedAt == nil {
+		return statusDegraded(nil, "scheduler has never ticked")
+	}
+	return statusThreshold(time.Since(*tickedAt).Seconds(), ConfigStatusSchedulerTickMax.Seconds(),
+		"last tick %.1fs ago exceeds %.1fs")
+}
+
+// StatusCheckPins checks the number of seconds by which the most
+// overdue pin has missed its refresh. A pin is overdue once its
+// results are older than the pin refresh interval.
+func StatusCheckPins(ctx context.Context) *StatusCheck {
+	oldest, err := PinOldestRefresh(ctx)
+	if err != nil {
+		return statusDegraded(nil, "%s", err)
+	}
+	overdue := 0.0
+	if oldest != nil {
+		overdue = time.Since(oldest.Add(ConfigPinRefreshInterval)).Seconds()
+		if overdue < 0 {
+			overdue = 0
+		}
+	}
+	return statusThreshold(overdue, ConfigStatusPinOverdueMax.Seconds(),
+		"oldest pin overdue by %.1fs exceeds %.1fs")
+}
+
+// StatusGet runs all status checks. The returned status has the
+// message "ok" only if every check passed.
+func StatusGet(ctx context.Context) *Status {
+	status := &Status{
+		Message: "ok",
+		Checks: map[string]*StatusCheck{
+			"postgres":  StatusCheckPostgres(ctx),
+			"queue":     StatusCheckQueue(ctx),
+			"scheduler": StatusCheckScheduler(ctx),
+			"pins":      StatusCheckPins(ctx),
+		},
+	}
+	if ConfigQueueBackend == "redis" {
+		status.Checks["redis"] = StatusCheckRedis(ctx)
+	}
+	for _, check := range status.Checks {
+		if check.Status != "ok" {
+			status.Message = "degraded"
+		}
+	}
+	return status
+}
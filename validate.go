@@ -32,6 +32,17 @@ func ValidateSlug(f string, s string) error {
 	return nil
 }
 
+func ValidateRange(f string, n int, min int, max int) error {
+	if n < min || n > max {
+		return &PgpinError{
+			Id:         "invalid",
+			Message:    fmt.Sprintf("field %s must be between %d and %d", f, min, max),
+			HttpStatus: 400,
+		}
+	}
+	return nil
+}
+
 func ValidatePgUrl(f string, s string) error {
 	u, err := url.Parse(s)
 	if err != nil || (u.Scheme != "postgres") {
@@ -14,11 +14,12 @@ apt-get update
 apt-get install -y --no-install-recommends build-essential curl git-core mercurial bzr
 
 mkdir -p /opt/go
-curl -s https://storage.googleapis.com/golang/go1.3.linux-amd64.tar.gz | tar xzf - -C /opt/go --strip-components=1
+curl -s https://dl.google.com/go/go1.16.15.linux-amd64.tar.gz | tar xzf - -C /opt/go --strip-components=1
 
 cat >> /home/vagrant/.profile <<EOF
 export GOROOT=/opt/go
 export GOPATH=\$HOME
+export GO111MODULE=off
 export PATH=\$HOME/bin:/opt/go/bin:\$PATH
 EOF
 
@@ -34,7 +35,7 @@ EOF
 curl -s https://www.postgresql.org/media/keys/ACCC4CF8.asc | apt-key add -
 apt-get update
 
-apt-get install -y --no-install-recommends postgresql-9.3
+apt-get install -y --no-install-recommends postgresql-9.6
 
 sudo -u postgres psql -U postgres -d postgres -c "alter user postgres with password 'secret';"
 sudo -u postgres createdb pgpin-development
@@ -2,14 +2,22 @@ package main
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/stretchr/graceful"
 	"github.com/zenazn/goji/web"
+	"io"
 	"log"
 	"net/http"
+	"reflect"
+	"regexp"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,13 +38,103 @@ func WebRead(req *http.Request, dataRef interface{}) error {
 	return nil
 }
 
+// WebReadFields reads the JSON object request body into the targets
+// named by its fields, as a JSON Merge Patch (RFC 7396) of the flat
+// resource v: each field's value is unmarshalled into its target,
+// and the targets of null fields are zeroed. Fields of v's JSON
+// representation without targets are read-only. If replace is set,
+// as for PUTs, targets of fields not given are also zeroed and
+// read-only fields are ignored, so that a fetched representation can
+// be put back. Otherwise read-only fields are rejected, as are
+// unknown fields in either case.
+func WebReadFields(req *http.Request, v interface{}, targets map[string]interface{}, replace bool) error {
+	fields := map[string]json.RawMessage{}
+	err := WebRead(req, &fields)
+	if err != nil {
+		return err
+	}
+	representation := webJsonFields(v)
+	unknownNames, readOnlyNames := []string{}, []string{}
+	for name := range fields {
+		_, ok := targets[name]
+		switch {
+		case ok:
+		case !representation[name]:
+			unknownNames = append(unknownNames, name)
+		case !replace:
+			readOnlyNames = append(readOnlyNames, name)
+		}
+	}
+	if len(unknownNames) > 0 || len(readOnlyNames) > 0 {
+		sort.Strings(unknownNames)
+		sort.Strings(readOnlyNames)
+		problems := []string{}
+		if len(unknownNames) > 0 {
+			problems = append(problems, "unknown fields "+strings.Join(unknownNames, ", "))
+		}
+		if len(readOnlyNames) > 0 {
+			problems = append(problems, "read-only fields "+strings.Join(readOnlyNames, ", "))
+		}
+		return &PgpinError{
+			Id:         "invalid",
+			Message:    "body has " + strings.Join(problems, " and "),
+			HttpStatus: 400,
+		}
+	}
+	names := []string{}
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := fields[name]
+		if !ok && !replace {
+			continue
+		}
+		if !ok || string(value) == "null" {
+			target := reflect.ValueOf(targets[name]).Elem()
+			target.Set(reflect.Zero(target.Type()))
+			continue
+		}
+		err = json.Unmarshal(value, targets[name])
+		if err != nil {
+			return &PgpinError{
+				Id:         "invalid",
+				Message:    fmt.Sprintf("field %s has the wrong type", name),
+				HttpStatus: 400,
+			}
+		}
+	}
+	return nil
+}
+
+// webJsonFields returns the names of the fields in the JSON
+// representation of the struct pointed to by v.
+func webJsonFields(v interface{}) map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
 // WebRespond writes an HTTP response to the given resp, either
 // according to status and data if err is nil, or according to err
 // if it's non-nil. It will attempt to coerce err into a PgpinError
 // and respond with an appropriate error message, falling back to
-// a generic 500 error if it can't. All web responses should go
-// through this function.
+// a generic 500 error if it can't. 304 Not Modified responses are
+// written without a body or Content-Type. All web responses should
+// go through this function.
 func WebRespond(resp http.ResponseWriter, status int, data interface{}, err error) {
+	if err == nil && status == 304 {
+		resp.Header().Del("Content-Type")
+		resp.WriteHeader(status)
+		return
+	}
 	if err != nil {
 		pgerr, ok := err.(*PgpinError)
 		if ok {
@@ -44,6 +142,9 @@ func WebRespond(resp http.ResponseWriter, status int, data interface{}, err erro
 			data = pgerr
 		} else {
 			log.Printf("web.error %+s", err.Error())
+			ReportError("web", err, map[string]string{
+				"request_id": resp.Header().Get("Request-Id"),
+			})
 			status = 500
 			data = &map[string]string{
 				"id":      "internal-error",
@@ -91,7 +192,8 @@ func WebRequestIder(c *web.C, h http.Handler) http.Handler {
 			requestId = uuid.New()
 		}
 		resp.Header().Set("Request-Id", requestId)
-		h.ServeHTTP(resp, req)
+		ctx := ContextWithRequestId(req.Context(), requestId)
+		h.ServeHTTP(resp, req.WithContext(ctx))
 	}
 	return http.HandlerFunc(fn)
 }
@@ -110,6 +212,14 @@ func WebLogger(c *web.C, inner http.Handler) http.Handler {
 	return http.HandlerFunc(outer)
 }
 
+// webStreamingPaths matches the paths of endpoints that stream
+// their responses.
+var webStreamingPaths = regexp.MustCompile(`^/v1/pins/[^/]+/results$`)
+
+// WebTimer times out requests after timeout. Streaming endpoints
+// are exempt, as http.TimeoutHandler buffers whole responses, and
+// instead have their contexts cancelled after
+// ConfigWebStreamTimeout.
 func WebTimer(timeout time.Duration) func(http.Handler) http.Handler {
 	return func(inner http.Handler) http.Handler {
 		data := &map[string]string{
@@ -118,7 +228,17 @@ func WebTimer(timeout time.Duration) func(http.Handler) http.Handler {
 		}
 		body, err := json.MarshalIndent(data, "", "  ")
 		Must(err)
-		return http.TimeoutHandler(inner, timeout, string(body)+"\n")
+		timed := http.TimeoutHandler(inner, timeout, string(body)+"\n")
+		outer := func(resp http.ResponseWriter, req *http.Request) {
+			if !webStreamingPaths.MatchString(req.URL.Path) {
+				timed.ServeHTTP(resp, req)
+				return
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), ConfigWebStreamTimeout)
+			defer cancel()
+			inner.ServeHTTP(resp, req.WithContext(ctx))
+		}
+		return http.HandlerFunc(outer)
 	}
 }
 
@@ -128,6 +248,9 @@ func WebRecoverer(h http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				log.Printf("web.panic: %s", err)
 				log.Print(string(debug.Stack()))
+				ReportPanic("web", err, map[string]string{
+					"request_id": ContextRequestId(req.Context()),
+				})
 				WebRespond(resp, 0, nil, &PgpinError{
 					Id:         "internal-error",
 					Message:    "internal server error",
@@ -148,7 +271,7 @@ type DbSlim struct {
 }
 
 func WebDbList(resp http.ResponseWriter, req *http.Request) {
-	dbs, err := DbList("")
+	dbs, err := DbList(req.Context(), "")
 	dbSlims := []*DbSlim{}
 	for _, db := range dbs {
 		dbSlims = append(dbSlims, &DbSlim{Id: db.Id, Name: db.Name})
@@ -160,37 +283,72 @@ func WebDbCreate(resp http.ResponseWriter, req *http.Request) {
 	db := &Db{}
 	err := WebRead(req, db)
 	if err == nil {
-		db, err = DbCreate(db.Name, db.Url)
+		if db.MaxQueries == 0 {
+			db.MaxQueries = ConfigDbMaxQueries
+		}
+		db, err = DbCreate(req.Context(), db.Name, db.Url, db.MaxQueries)
+	}
+	if err == nil {
+		resp.Header().Set("ETag", WebDbEtag(db))
 	}
 	WebRespond(resp, 201, db, err)
 }
 
+// WebDbUpdate replaces the db's writable fields with those of the
+// request body, failing with a 412 if the request's If-Match doesn't
+// match the db's current ETag.
 func WebDbUpdate(c web.C, resp http.ResponseWriter, req *http.Request) {
-	dbUpdate := &Db{}
-	db := &Db{}
-	err := WebRead(req, dbUpdate)
+	webDbWrite(c, resp, req, true)
+}
+
+// WebDbPatch applies the request body to the db as a JSON Merge
+// Patch, failing with a 412 if the request's If-Match doesn't match
+// the db's current ETag.
+func WebDbPatch(c web.C, resp http.ResponseWriter, req *http.Request) {
+	webDbWrite(c, resp, req, false)
+}
+
+func webDbWrite(c web.C, resp http.ResponseWriter, req *http.Request, replace bool) {
+	db, err := DbGet(req.Context(), c.URLParams["id"])
 	if err == nil {
-		db, err = DbGet(c.URLParams["id"])
-		if err == nil {
-			if dbUpdate.Name != "" {
-				db.Name = dbUpdate.Name
-			}
-			if dbUpdate.Url != "" {
-				db.Url = dbUpdate.Url
-			}
-			err = DbUpdate(db)
+		err = WebCheckIfMatch(req, WebDbEtag(db))
+	}
+	if err == nil {
+		fields := map[string]interface{}{
+			"name":        &db.Name,
+			"url":         &db.Url,
+			"max_queries": &db.MaxQueries,
+		}
+		err = WebReadFields(req, db, fields, replace)
+	}
+	if err == nil {
+		if db.MaxQueries == 0 {
+			db.MaxQueries = ConfigDbMaxQueries
 		}
+		err = DbUpdate(req.Context(), db)
+	}
+	if err == nil {
+		resp.Header().Set("ETag", WebDbEtag(db))
 	}
 	WebRespond(resp, 200, db, err)
 }
 
 func WebDbGet(c web.C, resp http.ResponseWriter, req *http.Request) {
-	db, err := DbGet(c.URLParams["id"])
+	db, err := DbGet(req.Context(), c.URLParams["id"])
+	if err == nil {
+		resp.Header().Set("ETag", WebDbEtag(db))
+	}
 	WebRespond(resp, 200, db, err)
 }
 
+// WebDbEtag returns the ETag for the db, which changes whenever
+// it's updated.
+func WebDbEtag(db *Db) string {
+	return fmt.Sprintf(`"%s-%d"`, db.Id, db.Version)
+}
+
 func WebDbDelete(c web.C, resp http.ResponseWriter, req *http.Request) {
-	db, err := DbDelete(c.URLParams["id"])
+	db, err := DbDelete(req.Context(), c.URLParams["id"])
 	WebRespond(resp, 200, db, err)
 }
 
@@ -202,7 +360,7 @@ type PinSlim struct {
 }
 
 func WebPinList(resp http.ResponseWriter, req *http.Request) {
-	pins, err := PinList("")
+	pins, err := PinList(req.Context(), "")
 	pinSlims := []*PinSlim{}
 	for _, pin := range pins {
 		pinSlims = append(pinSlims, &PinSlim{Id: pin.Id, Name: pin.Name})
@@ -214,50 +372,357 @@ func WebPinCreate(resp http.ResponseWriter, req *http.Request) {
 	pin := &Pin{}
 	err := WebRead(req, pin)
 	if err == nil {
-		pin, err = PinCreate(pin.DbId, pin.Name, pin.Query)
+		if pin.MaxRows == 0 {
+			pin.MaxRows = ConfigPinResultsRowsMax
+		}
+		pin, err = PinCreate(req.Context(), pin.DbId, pin.Name, pin.Query, pin.MaxRows)
+	}
+	if err == nil {
+		resp.Header().Set("ETag", WebPinEtag(pin))
 	}
 	WebRespond(resp, 201, pin, err)
 }
 
+// WebPinUpdate replaces the pin's writable fields with those of the
+// request body, failing with a 412 if the request's If-Match doesn't
+// match the pin's current ETag. Scheduled refreshes change the ETag
+// too, so clients should re-fetch the pin and retry on a 412.
 func WebPinUpdate(c web.C, resp http.ResponseWriter, req *http.Request) {
-	pinUpdate := &Pin{}
-	pin := &Pin{}
-	err := WebRead(req, pinUpdate)
+	webPinWrite(c, resp, req, true)
+}
+
+// WebPinPatch applies the request body to the pin as a JSON Merge
+// Patch, failing with a 412 if the request's If-Match doesn't match
+// the pin's current ETag.
+func WebPinPatch(c web.C, resp http.ResponseWriter, req *http.Request) {
+	webPinWrite(c, resp, req, false)
+}
+
+func webPinWrite(c web.C, resp http.ResponseWriter, req *http.Request, replace bool) {
+	pin, err := PinGet(req.Context(), c.URLParams["id"])
 	if err == nil {
-		pin, err = PinGet(c.URLParams["id"])
-		if err == nil {
-			if pinUpdate.Name != "" {
-				pin.Name = pinUpdate.Name
-			}
-			if pinUpdate.Query != "" {
-				pin.Query = pinUpdate.Query
-			}
-			err = PinUpdate(pin)
+		err = WebCheckIfMatch(req, WebPinEtag(pin))
+	}
+	if err == nil {
+		fields := map[string]interface{}{
+			"name":     &pin.Name,
+			"query":    &pin.Query,
+			"max_rows": &pin.MaxRows,
 		}
+		err = WebReadFields(req, pin, fields, replace)
+	}
+	if err == nil {
+		if pin.MaxRows == 0 {
+			pin.MaxRows = ConfigPinResultsRowsMax
+		}
+		err = PinUpdate(req.Context(), pin)
+	}
+	if err == nil {
+		resp.Header().Set("ETag", WebPinEtag(pin))
 	}
 	WebRespond(resp, 200, pin, err)
 }
 
+// WebCheckIfMatch returns a precondition-failed error if the
+// request has an If-Match header that doesn't match etag, as when
+// the resource was updated since the client fetched it. As in RFC
+// 7232, weak ETags never match.
+func WebCheckIfMatch(req *http.Request, etag string) error {
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate == etag && !strings.HasPrefix(etag, "W/")) {
+			return nil
+		}
+	}
+	return &PgpinError{
+		Id:         "precondition-failed",
+		Message:    "resource was modified since it was fetched",
+		HttpStatus: 412,
+	}
+}
+
+// WebPinGet responds with the pin and its results, or with a 304
+// if the client's copy is current.
 func WebPinGet(c web.C, resp http.ResponseWriter, req *http.Request) {
-	pin, err := PinGet(c.URLParams["id"])
+	pin, err := PinGet(req.Context(), c.URLParams["id"])
+	if err == nil {
+		etag := WebPinEtag(pin)
+		WebCacheHeaders(resp, pin, etag)
+		if WebNotModified(req, etag, pin.QueryFinishedAt) {
+			WebRespond(resp, 304, nil, nil)
+			return
+		}
+		// The pin is read again if it was run since, so the headers
+		// are set again to match the results loaded.
+		err = PinLoadResults(req.Context(), pin)
+		if err == nil {
+			WebCacheHeaders(resp, pin, WebPinEtag(pin))
+		}
+	}
 	WebRespond(resp, 200, pin, err)
 }
 
+// WebPinEtag returns the ETag for the pin, which changes whenever
+// it's updated, including by runs. As the pin's representation
+// includes its results, the same ETag serves both conditional GETs
+// and If-Match, so a refresh between a client's fetch and update
+// fails the update with a 412 even though no writable field changed.
+func WebPinEtag(pin *Pin) string {
+	return fmt.Sprintf(`"%s-%d"`, pin.Id, pin.Version)
+}
+
+// WebCacheHeaders sets the caching headers for responses with the
+// pin or its results: the given ETag, Last-Modified from when the
+// pin was last run, and Cache-Control allowing caching until the
+// pin is next due for a refresh.
+func WebCacheHeaders(resp http.ResponseWriter, pin *Pin, etag string) {
+	header := resp.Header()
+	header.Set("ETag", etag)
+	if pin.QueryFinishedAt == nil {
+		header.Set("Cache-Control", "no-cache")
+		return
+	}
+	header.Set("Last-Modified", pin.QueryFinishedAt.UTC().Format(http.TimeFormat))
+	maxAge := int(time.Until(pin.QueryFinishedAt.Add(ConfigPinRefreshInterval)).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+}
+
+// WebNotModified returns whether the request's conditional headers
+// show that the client has the current representation, given its
+// ETag and modification time. As in RFC 7232, If-None-Match is
+// compared weakly and takes precedence over If-Modified-Since.
+func WebNotModified(req *http.Request, etag string, modifiedAt *time.Time) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" && modifiedAt != nil {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !modifiedAt.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
 func WebPinDelete(c web.C, resp http.ResponseWriter, req *http.Request) {
-	pin, err := PinDelete(c.URLParams["id"])
+	pin, err := PinDelete(req.Context(), c.URLParams["id"])
 	WebRespond(resp, 200, pin, err)
 }
 
-// Misc endpoints.
+// webResultsFormats maps the formats pin results can be downloaded
+// in to their content types.
+var webResultsFormats = map[string]string{
+	"json":   "application/json; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
 
-type Status struct {
-	Message string `json:"message"`
+// WebResultsFormat returns the results format requested by the
+// format query parameter or, failing that, the Accept header. It
+// defaults to json.
+func WebResultsFormat(req *http.Request) (string, error) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		accept := req.Header.Get("Accept")
+		switch {
+		case strings.Contains(accept, "text/csv"):
+			format = "csv"
+		case strings.Contains(accept, "application/x-ndjson"):
+			format = "ndjson"
+		default:
+			format = "json"
+		}
+	}
+	if _, ok := webResultsFormats[format]; !ok {
+		return "", &PgpinError{
+			Id:         "bad-request",
+			Message:    "results format must be one of json, ndjson, or csv",
+			HttpStatus: 400,
+		}
+	}
+	return format, nil
+}
+
+// WebResultsEtag returns the ETag for the pin's results in the
+// given format, which changes whenever the pin is run. It's weak as
+// the results are served with varying content encodings.
+func WebResultsEtag(pin *Pin, format string) string {
+	finishedAt := int64(0)
+	if pin.QueryFinishedAt != nil {
+		finishedAt = pin.QueryFinishedAt.UnixNano()
+	}
+	return fmt.Sprintf(`W/"%s-%d-%s"`, pin.Id, finishedAt, format)
 }
 
+// webAcceptsGzip returns whether the request's Accept-Encoding
+// allows gzip.
+func webAcceptsGzip(req *http.Request) bool {
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(coding, ";")
+		if strings.TrimSpace(parts[0]) == "gzip" {
+			return len(parts) == 1 || strings.Replace(parts[1], " ", "", -1) != "q=0"
+		}
+	}
+	return false
+}
+
+// webResultsCsvSet returns the index of the result set to download
+// as CSV: that given by the set query parameter, or the last.
+func webResultsCsvSet(ctx context.Context, req *http.Request, pin *Pin) (int, error) {
+	blob, err := PinOpenResults(ctx, pin)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { Must(blob.Close()) }()
+	sets, err := ResultsHeaders(blob)
+	if err != nil {
+		return 0, err
+	}
+	index := len(sets) - 1
+	if param := req.URL.Query().Get("set"); param != "" {
+		index, err = strconv.Atoi(param)
+		if err != nil {
+			index = -1
+		}
+	}
+	if index < 0 || index >= len(sets) {
+		return 0, &PgpinError{
+			Id:         "results-set-not-found",
+			Message:    "results set not found",
+			HttpStatus: 404,
+		}
+	}
+	if sets[index].Error != nil {
+		return 0, &PgpinError{
+			Id:         "results-set-failed",
+			Message:    *sets[index].Error,
+			HttpStatus: 422,
+		}
+	}
+	return index, nil
+}
+
+// WebPinResults streams the pin's latest results from BlobBackend,
+// without holding them in memory. Results are written in the format
+// given by WebResultsFormat: json, as an array of result sets like
+// results_sets; ndjson, in the form they're stored in; or csv, for
+// one result set as chosen by webResultsCsvSet. Responses are
+// gzipped for clients accepting it, and 304s are returned if the
+// client's copy is current.
+func WebPinResults(c web.C, resp http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	format, err := WebResultsFormat(req)
+	pin := &Pin{}
+	if err == nil {
+		pin, err = PinGet(ctx, c.URLParams["id"])
+	}
+	if err == nil {
+		etag := WebResultsEtag(pin, format)
+		WebCacheHeaders(resp, pin, etag)
+		resp.Header().Set("Vary", "Accept, Accept-Encoding")
+		if WebNotModified(req, etag, pin.QueryFinishedAt) {
+			WebRespond(resp, 304, nil, nil)
+			return
+		}
+	}
+	setIndex := 0
+	if err == nil && format == "csv" {
+		setIndex, err = webResultsCsvSet(ctx, req, pin)
+	}
+	var blob io.ReadCloser
+	if err == nil {
+		blob, err = PinOpenResults(ctx, pin)
+	}
+	if err != nil {
+		WebRespond(resp, 0, nil, err)
+		return
+	}
+	defer func() { Must(blob.Close()) }()
+	// As in WebPinGet, the headers match the pin as last read.
+	WebCacheHeaders(resp, pin, WebResultsEtag(pin, format))
+	gzipped := webAcceptsGzip(req)
+	header := resp.Header()
+	header.Set("Content-Type", webResultsFormats[format])
+	if gzipped {
+		header.Set("Content-Encoding", "gzip")
+	}
+	resp.WriteHeader(200)
+	if format == "ndjson" && gzipped {
+		_, err = io.Copy(resp, blob)
+	} else {
+		err = webWriteResults(resp, blob, format, setIndex, gzipped)
+	}
+	if err != nil {
+		log.Printf("web.ioerror request_id=%s pin_id=%s %s", ContextRequestId(ctx), pin.Id, err)
+	}
+}
+
+func webWriteResults(resp io.Writer, blob io.Reader, format string, setIndex int, gzipped bool) error {
+	w := resp
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(resp)
+		w = gz
+	}
+	reader, err := ResultsNewReader(blob)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "ndjson":
+		err = ResultsWriteNdjson(w, reader)
+	case "csv":
+		err = ResultsWriteCsv(w, reader, setIndex)
+	default:
+		err = ResultsWriteJson(w, reader)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// Job endpoints.
+
+func WebDeadJobList(resp http.ResponseWriter, req *http.Request) {
+	deadJobs, err := DeadJobList(req.Context())
+	WebRespond(resp, 200, deadJobs, err)
+}
+
+func WebDeadJobReplay(c web.C, resp http.ResponseWriter, req *http.Request) {
+	deadJob, err := DeadJobReplay(req.Context(), c.URLParams["id"])
+	WebRespond(resp, 200, deadJob, err)
+}
+
+// Worker endpoints.
+
+func WebWorkerList(resp http.ResponseWriter, req *http.Request) {
+	heartbeats, err := HeartbeatList(req.Context())
+	WebRespond(resp, 200, heartbeats, err)
+}
+
+// Misc endpoints.
+
+// WebStatus responds with the results of the system status checks,
+// with a 503 if any are degraded.
 func WebStatus(resp http.ResponseWriter, req *http.Request) {
-	err := PgConn.Ping()
-	status := &Status{Message: "ok"}
-	WebRespond(resp, 200, status, err)
+	status := StatusGet(req.Context())
+	code := 200
+	if status.Message != "ok" {
+		code = 503
+	}
+	WebRespond(resp, code, status, nil)
 }
 
 func WebTriggerError(resp http.ResponseWriter, req *http.Request) {
@@ -304,13 +769,19 @@ func WebBuild() {
 	WebMux.Get("/v1/dbs", WebDbList)
 	WebMux.Post("/v1/dbs", WebDbCreate)
 	WebMux.Put("/v1/dbs/:id", WebDbUpdate)
+	WebMux.Patch("/v1/dbs/:id", WebDbPatch)
 	WebMux.Get("/v1/dbs/:id", WebDbGet)
 	WebMux.Delete("/v1/dbs/:id", WebDbDelete)
 	WebMux.Get("/v1/pins", WebPinList)
 	WebMux.Post("/v1/pins", WebPinCreate)
 	WebMux.Put("/v1/pins/:id", WebPinUpdate)
+	WebMux.Patch("/v1/pins/:id", WebPinPatch)
 	WebMux.Get("/v1/pins/:id", WebPinGet)
+	WebMux.Get("/v1/pins/:id/results", WebPinResults)
 	WebMux.Delete("/v1/pins/:id", WebPinDelete)
+	WebMux.Get("/v1/jobs/dead", WebDeadJobList)
+	WebMux.Post("/v1/jobs/dead/:id/replay", WebDeadJobReplay)
+	WebMux.Get("/v1/workers", WebWorkerList)
 	WebMux.Get("/status", WebStatus)
 	WebMux.Get("/error", WebTriggerError)
 	WebMux.Get("/panic", WebTriggerPanic)
@@ -321,8 +792,10 @@ func WebBuild() {
 
 func WebStart() {
 	log.Print("web.start")
+	ReportStart()
 	PgStart()
-	RedisStart()
+	QueueStart()
+	BlobStart()
 	WebBuild()
 	addr := fmt.Sprintf(":%d", ConfigWebPort)
 	graceful.Run(addr, ConfigWebDrainInterval, WebMux)
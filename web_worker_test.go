@@ -1,9 +1,21 @@
 package main
 
 import (
+	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -24,6 +36,101 @@ func TestRequestIdGiven(t *testing.T) {
 	assert.Equal(t, "given", res.Header().Get("Request-Id"))
 }
 
+func TestRequestIdEnqueued(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	b := asReader(`{"name": "pins-1", "db_id": "` + dbIn.Id + `", "query": "select 1"}`)
+	req, err := http.NewRequest("POST", "/v1/pins", b)
+	Must(err)
+	req.Header.Set("Request-Id", "given")
+	res := httptest.NewRecorder()
+	WebMux.ServeHTTP(res, req)
+	assert.Equal(t, 201, res.Code)
+	jobs := testQueue.Jobs(WorkerQueue(WorkerPriorityInteractive))
+	assert.Equal(t, 1, len(jobs))
+	job, err := WorkerParseJob(jobs[0].Payload)
+	Must(err)
+	assert.Equal(t, "given", job.RequestId)
+	assert.Equal(t, WorkerPriorityInteractive, job.Priority)
+}
+
+func TestWorkerApplicationName(t *testing.T) {
+	assert.Equal(t, "pgpin.pin.p", WorkerApplicationName("p", ""))
+	assert.Equal(t, "pgpin.r.p", WorkerApplicationName("p", "r"))
+	pinId, requestId := uuid.New(), uuid.New()
+	name := WorkerApplicationName(pinId, requestId)
+	assert.Equal(t, "pgpin."+requestId+"."+pinId[:8], name)
+	assert.True(t, len(name) <= 63)
+	name = WorkerApplicationName(pinId, strings.Repeat("r", 100))
+	assert.Equal(t, 63, len(name))
+	assert.True(t, strings.HasSuffix(name, "."+pinId[:8]))
+	assert.Equal(t, "pgpin.r?s?t.p", WorkerApplicationName("p", "r\u00e9s\xfft"))
+}
+
+func TestWorkerCoerceType(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	pool, err := DbPoolGet(mustDbCreate("dbs-1", ConfigDatabaseUrl))
+	Must(err)
+	conn, err := pool.Conn(ctx)
+	Must(err)
+	defer func() { Must(conn.Close()) }()
+	_, err = conn.ExecContext(ctx, "SET TIME ZONE 'UTC'")
+	Must(err)
+	cases := []struct {
+		expr string
+		out  string
+	}{
+		{"null::int4", `null`},
+		{"42::int2", `42`},
+		{"42::int4", `42`},
+		{"9007199254740993::int8", `9007199254740993`},
+		{"12345678901234567890.123456789::numeric", `12345678901234567890.123456789`},
+		{"'NaN'::numeric", `"NaN"`},
+		{"1.5::float8", `1.5`},
+		{"'Infinity'::float8", `"Infinity"`},
+		{"'NaN'::float4", `"NaN"`},
+		{"true", `true`},
+		{"'a b'::text", `"a b"`},
+		{"'a'::varchar(3)", `"a"`},
+		{"'ab'::char(3)", `"ab "`},
+		{`'{"a": [1, 2]}'::json`, `{"a":[1,2]}`},
+		{`'{"a": [1, 2]}'::jsonb`, `{"a":[1,2]}`},
+		{"'\\x00ff'::bytea", `"AP8="`},
+		{"'2015-01-02 03:04:05.678+00'::timestamptz", `"2015-01-02T03:04:05.678Z"`},
+		{"'2015-01-02 03:04:05'::timestamp", `"2015-01-02T03:04:05"`},
+		{"'infinity'::timestamptz", `"infinity"`},
+		{"'2015-01-02'::date", `"2015-01-02"`},
+		{"'03:04:05.5'::time", `"03:04:05.5"`},
+		{"'03:04:05+02'::timetz", `"03:04:05+02:00"`},
+		{"'1 day 2 hours 3 seconds'::interval", `"P1DT2H3S"`},
+		{"'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::uuid", `"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"`},
+		{"'192.168.0.1/24'::inet", `"192.168.0.1/24"`},
+		{"'10.0.0.0/8'::cidr", `"10.0.0.0/8"`},
+		{"'08:00:2b:01:02:03'::macaddr", `"08:00:2b:01:02:03"`},
+		{"array[1, 2, null]::int4[]", `[1,2,null]`},
+		{"array[[1.5, 2], [3, 4]]::numeric[]", `[[1.5,2],[3,4]]`},
+		{"array['a', 'b c', 'd,\"e']::text[]", `["a","b c","d,\"e"]`},
+		{"array[true, false]", `[true,false]`},
+		{`array['{"a": 1}']::jsonb[]`, `[{"a":1}]`},
+		{"array['\\x01'::bytea]", `["AQ=="]`},
+		{"array['2015-01-02 03:04:05+00'::timestamptz]", `["2015-01-02T03:04:05Z"]`},
+	}
+	for _, c := range cases {
+		rows, err := conn.QueryContext(ctx, "SELECT "+c.expr)
+		Must(err)
+		types, err := rows.ColumnTypes()
+		Must(err)
+		assert.True(t, rows.Next(), c.expr)
+		var value interface{}
+		Must(rows.Scan(&value))
+		Must(rows.Close())
+		out, err := json.Marshal(WorkerCoerceType(types[0].DatabaseTypeName(), value))
+		Must(err)
+		assert.Equal(t, c.out, string(out), c.expr)
+	}
+}
+
 // DB endpoints.
 
 func TestDbCreate(t *testing.T) {
@@ -35,10 +142,32 @@ func TestDbCreate(t *testing.T) {
 	mustDecode(res, dbOut)
 	assert.Equal(t, "dbs-1", dbOut.Name)
 	assert.Equal(t, "postgres://u:p@h:1234/d-1", dbOut.Url)
+	assert.Equal(t, ConfigDbMaxQueries, dbOut.MaxQueries)
 	assert.NotEmpty(t, dbOut.Id)
 	assert.WithinDuration(t, time.Now(), dbOut.AddedAt, 3*time.Second)
 }
 
+func TestDbCreateInvalidMaxQueries(t *testing.T) {
+	defer clear()
+	b := asReader(`{"name": "dbs-1", "url": "postgres://u:p@h:1234/d-1", "max_queries": -1}`)
+	res := mustRequest("POST", "/v1/dbs", b)
+	assert.Equal(t, 400, res.Code)
+	data := make(map[string]string)
+	mustDecode(res, &data)
+	assert.Equal(t, "invalid", data["id"])
+}
+
+func TestDbUpdateMaxQueries(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	b := asReader(`{"max_queries": 4}`)
+	res := mustRequest("PATCH", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	dbGetOut, err := DbGet(context.Background(), dbIn.Id)
+	Must(err)
+	assert.Equal(t, 4, dbGetOut.MaxQueries)
+}
+
 func TestDbCreateDuplicateName(t *testing.T) {
 	defer clear()
 	mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
@@ -80,7 +209,7 @@ func TestDbUpdateName(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
 	b := asReader(`{"name": "dbs-1a"}`)
-	res := mustRequest("PUT", "/v1/dbs/"+dbIn.Id, b)
+	res := mustRequest("PATCH", "/v1/dbs/"+dbIn.Id, b)
 	assert.Equal(t, 200, res.Code)
 	dbPutOut := &Db{}
 	mustDecode(res, dbPutOut)
@@ -97,7 +226,7 @@ func TestDbUpdateUrl(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
 	b := asReader(`{"url": "postgres://u:p@h:1234/d-1a"}`)
-	res := mustRequest("PUT", "/v1/dbs/"+dbIn.Id, b)
+	res := mustRequest("PATCH", "/v1/dbs/"+dbIn.Id, b)
 	assert.Equal(t, 200, res.Code)
 	dbPutOut := &Db{}
 	mustDecode(res, dbPutOut)
@@ -112,6 +241,47 @@ func TestDbUpdateUrl(t *testing.T) {
 	assert.True(t, dbGetOut.UpdatedAt.After(dbIn.UpdatedAt))
 }
 
+func TestDbPut(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	b := asReader(`{"name": "dbs-1a", "url": "postgres://u:p@h:1234/d-1a", "max_queries": 4}`)
+	res := mustRequest("PATCH", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	res = mustRequest("GET", "/v1/dbs/"+dbIn.Id, nil)
+	b = asReader(strings.Replace(res.Body.String(), "dbs-1a", "dbs-1b", 1))
+	res = mustRequest("PUT", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	dbPutOut := &Db{}
+	mustDecode(res, dbPutOut)
+	assert.Equal(t, "dbs-1b", dbPutOut.Name)
+	assert.Equal(t, 4, dbPutOut.MaxQueries)
+	b = asReader(`{"name": "dbs-1c", "url": "postgres://u:p@h:1234/d-1c"}`)
+	res = mustRequest("PUT", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	dbPutOut = &Db{}
+	mustDecode(res, dbPutOut)
+	assert.Equal(t, ConfigDbMaxQueries, dbPutOut.MaxQueries)
+	b = asReader(`{"name": "dbs-1d"}`)
+	res = mustRequest("PUT", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 400, res.Code)
+}
+
+func TestDbPatchInvalidFields(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	b := asReader(`{"name": "dbs-1a", "created_at": "2015-01-01T00:00:00Z", "owner": "u"}`)
+	res := mustRequest("PATCH", "/v1/dbs/"+dbIn.Id, b)
+	assert.Equal(t, 400, res.Code)
+	data := map[string]string{}
+	mustDecode(res, &data)
+	assert.Equal(t, "body has unknown fields owner and read-only fields created_at", data["message"])
+	res = mustRequest("PUT", "/v1/dbs/"+dbIn.Id, asReader(`{"name": "dbs-1a", "url": "postgres://u:p@h:1234/d-1", "owner": "u"}`))
+	assert.Equal(t, 400, res.Code)
+	dbOut, err := DbGet(context.Background(), dbIn.Id)
+	Must(err)
+	assert.Equal(t, "dbs-1", dbOut.Name)
+}
+
 func TestDbDelete(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
@@ -137,7 +307,7 @@ func TestDbList(t *testing.T) {
 	defer clear()
 	dbIn1 := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
 	dbIn2 := mustDbCreate("dbs-2", "postgres://u:p@h:1234/d-2")
-	_, err := DbDelete(dbIn2.Id)
+	_, err := DbDelete(context.Background(), dbIn2.Id)
 	Must(err)
 	res := mustRequest("GET", "/v1/dbs", nil)
 	assert.Equal(t, 200, res.Code)
@@ -166,6 +336,7 @@ func TestPinCreateAndGet(t *testing.T) {
 	assert.Equal(t, "pin-1", pinOut.Name)
 	assert.Equal(t, dbIn.Id, pinOut.DbId)
 	assert.Equal(t, "select count(*) from pins", pinOut.Query)
+	assert.Equal(t, ConfigPinResultsRowsMax, pinOut.MaxRows)
 	assert.WithinDuration(t, time.Now(), pinOut.CreatedAt, 3*time.Second)
 	assert.True(t, pinOut.QueryStartedAt.After(pinOut.CreatedAt))
 	assert.True(t, pinOut.QueryFinishedAt.After(*pinOut.QueryStartedAt))
@@ -204,7 +375,7 @@ func TestPinUpdateName(t *testing.T) {
 	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
 	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select count(*) from pins")
 	b := asReader(`{"name": "pins-1a"}`)
-	res := mustRequest("PUT", "/v1/pins/"+pinIn.Id, b)
+	res := mustRequest("PATCH", "/v1/pins/"+pinIn.Id, b)
 	assert.Equal(t, 200, res.Code)
 	pinPutOut := &Pin{}
 	mustDecode(res, pinPutOut)
@@ -222,7 +393,7 @@ func TestPinUpdateQuery(t *testing.T) {
 	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
 	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select count(*) from pins")
 	b := asReader(`{"query": "select now()"}`)
-	res := mustRequest("PUT", "/v1/pins/"+pinIn.Id, b)
+	res := mustRequest("PATCH", "/v1/pins/"+pinIn.Id, b)
 	assert.Equal(t, 200, res.Code)
 	pinPutOut := &Pin{}
 	mustDecode(res, pinPutOut)
@@ -236,6 +407,69 @@ func TestPinUpdateQuery(t *testing.T) {
 	assert.True(t, pinGetOut.UpdatedAt.After(pinIn.UpdatedAt))
 }
 
+func TestPinPatchClear(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	res := mustRequest("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"max_rows": 2}`))
+	assert.Equal(t, 200, res.Code)
+	res = mustRequest("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"max_rows": null}`))
+	assert.Equal(t, 200, res.Code)
+	pinOut := &Pin{}
+	mustDecode(res, pinOut)
+	assert.Equal(t, ConfigPinResultsRowsMax, pinOut.MaxRows)
+	assert.Equal(t, "select 1", pinOut.Query)
+	res = mustRequest("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"query": null}`))
+	assert.Equal(t, 400, res.Code)
+	data := map[string]string{}
+	mustDecode(res, &data)
+	assert.Equal(t, "invalid", data["id"])
+	assert.Equal(t, "field query must be nonempty", data["message"])
+}
+
+func TestPinPatchInvalidFields(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	b := asReader(`{"name": "pins-1a", "id": "x", "results_error": "x", "querry": "select 2", "refresh": 1}`)
+	res := mustRequest("PATCH", "/v1/pins/"+pinIn.Id, b)
+	assert.Equal(t, 400, res.Code)
+	data := map[string]string{}
+	mustDecode(res, &data)
+	assert.Equal(t, "invalid", data["id"])
+	assert.Equal(t, "body has unknown fields querry, refresh and read-only fields id, results_error", data["message"])
+	res = mustRequest("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"max_rows": "2"}`))
+	assert.Equal(t, 400, res.Code)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, "pins-1", pinOut.Name)
+}
+
+func TestPinPut(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	res := mustRequest("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"max_rows": 2}`))
+	assert.Equal(t, 200, res.Code)
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id, nil)
+	b := asReader(strings.Replace(res.Body.String(), "select 1", "select 2", 1))
+	res = mustRequest("PUT", "/v1/pins/"+pinIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	pinOut := &Pin{}
+	mustDecode(res, pinOut)
+	assert.Equal(t, "select 2", pinOut.Query)
+	assert.Equal(t, 2, pinOut.MaxRows)
+	res = mustRequest("PUT", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1a", "query": "select 3"}`))
+	assert.Equal(t, 200, res.Code)
+	pinOut = &Pin{}
+	mustDecode(res, pinOut)
+	assert.Equal(t, "pins-1a", pinOut.Name)
+	assert.Equal(t, ConfigPinResultsRowsMax, pinOut.MaxRows)
+	res = mustRequest("PUT", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1b"}`))
+	assert.Equal(t, 400, res.Code)
+	pinOut = mustPinGet(pinIn.Id)
+	assert.Equal(t, "select 3", pinOut.Query)
+}
+
 func TestPinMultipleColumns(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
@@ -250,6 +484,63 @@ func TestPinMultipleColumns(t *testing.T) {
 	assert.Nil(t, pinOut.ResultsError)
 }
 
+func TestPinResultsColumns(t *testing.T) {
+	defer clear()
+	_, err := PgConn.Exec("DROP TYPE IF EXISTS pgpin_test_mood; CREATE TYPE pgpin_test_mood AS ENUM ('ok')")
+	Must(err)
+	defer func() {
+		_, err := PgConn.Exec("DROP TYPE pgpin_test_mood")
+		Must(err)
+	}()
+	var moodOid uint32
+	Must(PgConn.QueryRow("SELECT 'pgpin_test_mood'::regtype::oid").Scan(&moodOid))
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1::int4 as a, 1.5::numeric(5,2) as b, 'x'::varchar(10) as c, 'y'::text as d, 'ok'::pgpin_test_mood as e")
+	mustWorkerTick()
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id, nil)
+	assert.Equal(t, 200, res.Code)
+	pinOut := &Pin{}
+	mustDecode(res, pinOut)
+	columns := []*PinResultsColumn{}
+	Must(json.Unmarshal(pinOut.ResultsColumns, &columns))
+	assert.Equal(t, 5, len(columns))
+	assert.Equal(t, "a", columns[0].Name)
+	assert.Equal(t, "int4", columns[0].Type)
+	assert.Equal(t, uint32(23), *columns[0].Oid)
+	assert.Nil(t, columns[0].Precision)
+	assert.Equal(t, "numeric", columns[1].Type)
+	assert.Equal(t, int64(5), *columns[1].Precision)
+	assert.Equal(t, int64(2), *columns[1].Scale)
+	assert.Equal(t, "varchar", columns[2].Type)
+	assert.Equal(t, int64(10), *columns[2].Length)
+	assert.Equal(t, "text", columns[3].Type)
+	assert.Nil(t, columns[3].Length)
+	assert.Equal(t, "pgpin_test_mood", columns[4].Type)
+	assert.Equal(t, moodOid, *columns[4].Oid)
+	assert.Equal(t, `[[1,1.5,"x","y","ok"]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+}
+
+func TestPinResultsColumnsNullable(t *testing.T) {
+	defer clear()
+	_, err := PgConn.Exec("DROP TABLE IF EXISTS pgpin_test_nullable; CREATE TABLE pgpin_test_nullable (a int4 NOT NULL, b int4); INSERT INTO pgpin_test_nullable VALUES (1, NULL)")
+	Must(err)
+	defer func() {
+		_, err := PgConn.Exec("DROP TABLE pgpin_test_nullable")
+		Must(err)
+	}()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select a, b, a + 1 as c from pgpin_test_nullable")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	columns := []*PinResultsColumn{}
+	Must(json.Unmarshal(pinOut.ResultsColumns, &columns))
+	assert.Equal(t, 3, len(columns))
+	assert.False(t, *columns[0].Nullable)
+	assert.True(t, *columns[1].Nullable)
+	assert.Nil(t, columns[2].Nullable)
+	assert.Equal(t, uint32(23), *columns[2].Oid)
+}
+
 func TestPinTooManyRows(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
@@ -259,9 +550,68 @@ func TestPinTooManyRows(t *testing.T) {
 	assert.Equal(t, 200, res.Code)
 	pinOut := &Pin{}
 	mustDecode(res, pinOut)
-	assert.Equal(t, "null", string([]byte(pinOut.ResultsFields)))
-	assert.Equal(t, "null", string([]byte(pinOut.ResultsRows)))
-	assert.Equal(t, "too many rows in query results", *pinOut.ResultsError)
+	rows := make([]interface{}, 0)
+	Must(json.Unmarshal(pinOut.ResultsRows, &rows))
+	assert.Equal(t, ConfigPinResultsRowsMax, len(rows))
+	assert.True(t, pinOut.ResultsTruncated)
+	assert.Equal(t, ConfigPinResultsRowsMax+1, *pinOut.ResultsRowCount)
+	assert.Nil(t, pinOut.ResultsError)
+}
+
+func TestPinMaxRows(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	b := asReader(`{"name": "pins-1", "db_id": "` + dbIn.Id + `", "query": "select generate_series(1, 5)", "max_rows": 2}`)
+	res := mustRequest("POST", "/v1/pins", b)
+	assert.Equal(t, 201, res.Code)
+	pinOut := &Pin{}
+	mustDecode(res, pinOut)
+	assert.Equal(t, 2, pinOut.MaxRows)
+	mustWorkerTick()
+	pinOut = mustPinGet(pinOut.Id)
+	assert.Equal(t, `[[1],[2]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+	assert.True(t, pinOut.ResultsTruncated)
+	assert.Equal(t, 3, *pinOut.ResultsRowCount)
+	b = asReader(`{"max_rows": 5}`)
+	res = mustRequest("PATCH", "/v1/pins/"+pinOut.Id, b)
+	assert.Equal(t, 200, res.Code)
+	Must(WorkerEnqueue(context.Background(), pinOut.Id, WorkerPriorityInteractive))
+	mustWorkerTick()
+	pinOut = mustPinGet(pinOut.Id)
+	assert.False(t, pinOut.ResultsTruncated)
+	assert.Equal(t, 5, *pinOut.ResultsRowCount)
+}
+
+func TestPinResultsBytesMax(t *testing.T) {
+	defer clear()
+	ConfigPinResultsBytesMaxPrev := ConfigPinResultsBytesMax
+	defer func() {
+		ConfigPinResultsBytesMax = ConfigPinResultsBytesMaxPrev
+	}()
+	ConfigPinResultsBytesMax = 30
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select repeat('x', 10) from generate_series(1, 5); select 1")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	resultsSets := []*PinResultsSet{}
+	Must(json.Unmarshal(pinOut.ResultsSets, &resultsSets))
+	assert.Equal(t, 2, len(resultsSets[0].Rows))
+	assert.True(t, resultsSets[0].Truncated)
+	assert.Equal(t, 0, len(resultsSets[1].Rows))
+	assert.True(t, pinOut.ResultsTruncated)
+	assert.True(t, pinOut.ResultsSize > 0)
+	assert.Nil(t, pinOut.ResultsError)
+}
+
+func TestPinCreateInvalidMaxRows(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	b := asReader(`{"name": "pins-1", "db_id": "` + dbIn.Id + `", "query": "select 1", "max_rows": ` + strconv.Itoa(ConfigPinResultsRowsMax+1) + `}`)
+	res := mustRequest("POST", "/v1/pins", b)
+	assert.Equal(t, 400, res.Code)
+	data := make(map[string]string)
+	mustDecode(res, &data)
+	assert.Equal(t, "invalid", data["id"])
 }
 
 func TestPinBadQuery(t *testing.T) {
@@ -278,6 +628,38 @@ func TestPinBadQuery(t *testing.T) {
 	assert.Equal(t, "column \"wat\" does not exist", *pinOut.ResultsError)
 }
 
+func TestPinMultipleStatements(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "set search_path = pg_catalog; select 1 as a; select wat; select 'b;' as b")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	resultsSets := []*PinResultsSet{}
+	Must(json.Unmarshal(pinOut.ResultsSets, &resultsSets))
+	assert.Equal(t, 4, len(resultsSets))
+	assert.Equal(t, []string{}, resultsSets[0].Fields)
+	assert.Nil(t, resultsSets[0].Error)
+	assert.Equal(t, []string{"a"}, resultsSets[1].Fields)
+	assert.Equal(t, `[[1]]`, mustCanonicalizeJson(MustNewPgJson(resultsSets[1].Rows)))
+	assert.Nil(t, resultsSets[2].Fields)
+	assert.Equal(t, "column \"wat\" does not exist", *resultsSets[2].Error)
+	assert.Equal(t, []string{"b"}, resultsSets[3].Fields)
+	assert.Nil(t, resultsSets[3].Error)
+	assert.Equal(t, `["b"]`, mustCanonicalizeJson(pinOut.ResultsFields))
+	assert.Equal(t, `[["b;"]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+	assert.Equal(t, "column \"wat\" does not exist", *pinOut.ResultsError)
+}
+
+func TestPinTemporaryTable(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "create temporary table pgpin_test_temp as select 1 as a; select a from pgpin_test_temp")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Nil(t, pinOut.ResultsError)
+	assert.Equal(t, `[[1]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+}
+
 func TestPinStatementTimeout(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
@@ -297,9 +679,24 @@ func TestPinStatementTimeout(t *testing.T) {
 	assert.Equal(t, "canceling statement due to statement timeout", *pinOut.ResultsError)
 }
 
+func TestPinQueryCancelled(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select pg_sleep(5)")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := WorkerProcess(ctx, "job-1", &WorkerJob{PinId: pinIn.Id, Attempt: 1})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Nil(t, pinOut.QueryFinishedAt)
+	assert.Nil(t, pinOut.ResultsError)
+}
+
 func TestPinMalformedDbUrl(t *testing.T) {
 	defer clear()
-	_, err := DbCreate("dbs-1", "not-a-url")
+	_, err := DbCreate(context.Background(), "dbs-1", "not-a-url", ConfigDbMaxQueries)
 	assert.Equal(t, "pgpin: invalid: field url must be a valid postgres:// URL", err.Error())
 }
 
@@ -317,21 +714,258 @@ func TestPinUnreachableRbUrl(t *testing.T) {
 	assert.Equal(t, "could not connect to database", *pinOut.ResultsError)
 }
 
+func TestPinRetryConnectionRefused(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@127.0.0.1:1/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, 1, pinOut.QueryAttempts)
+	assert.Nil(t, pinOut.QueryFinishedAt)
+	assert.Nil(t, pinOut.ResultsError)
+	jobs := testQueue.Jobs(WorkerQueue(WorkerPriorityInteractive))
+	assert.Equal(t, 1, len(jobs))
+	depth, err := testQueue.Depth(context.Background(), WorkerQueue(WorkerPriorityInteractive))
+	Must(err)
+	assert.Equal(t, 0, depth)
+	job, err := WorkerParseJob(jobs[0].Payload)
+	Must(err)
+	assert.Equal(t, pinIn.Id, job.PinId)
+	assert.Equal(t, 2, job.Attempt)
+}
+
+func TestPinRetryExhausted(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@127.0.0.1:1/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	err := WorkerProcess(context.Background(), "job-1", &WorkerJob{PinId: pinIn.Id, Attempt: ConfigWorkerRetryMax})
+	assert.Nil(t, err)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, ConfigWorkerRetryMax, pinOut.QueryAttempts)
+	assert.NotNil(t, pinOut.QueryFinishedAt)
+	assert.Equal(t, "could not connect to database", *pinOut.ResultsError)
+	deadJobs, err := DeadJobList(context.Background())
+	Must(err)
+	assert.Equal(t, 1, len(deadJobs))
+	assert.Equal(t, "job-1", deadJobs[0].JobId)
+	assert.Equal(t, pinIn.Id, deadJobs[0].PinId)
+	assert.Equal(t, ConfigWorkerRetryMax, deadJobs[0].Attempts)
+	assert.Contains(t, deadJobs[0].Error, "connection refused")
+}
+
+func TestWorkerRetryable(t *testing.T) {
+	assert.True(t, WorkerRetryable(driver.ErrBadConn))
+	assert.True(t, WorkerRetryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, WorkerRetryable(&pq.Error{Code: "55P03"}))
+	assert.True(t, WorkerRetryable(&pq.Error{Code: "08006"}))
+	assert.False(t, WorkerRetryable(&pq.Error{Code: "42703"}))
+	assert.False(t, WorkerRetryable(&pq.Error{Code: "57014"}))
+	assert.False(t, WorkerRetryable(errors.New("a problem occurred")))
+}
+
+func TestWorkerErrorMessage(t *testing.T) {
+	connectFailed := "could not connect to database"
+	assert.Equal(t, connectFailed, WorkerErrorMessage(&pq.Error{Code: "3D000", Message: `database "d-1" does not exist`}))
+	assert.Equal(t, connectFailed, WorkerErrorMessage(&pq.Error{Code: "28P01", Message: `password authentication failed for user "u"`}))
+	assert.Equal(t, connectFailed, WorkerErrorMessage(&pq.Error{Code: "08006", Message: "connection failure"}))
+	assert.Equal(t, connectFailed, WorkerErrorMessage(driver.ErrBadConn))
+	assert.Equal(t, `column "b" does not exist`, WorkerErrorMessage(&pq.Error{Code: "42703", Message: `column "b" does not exist`}))
+}
+
+func TestWorkerBackoff(t *testing.T) {
+	assert.Equal(t, ConfigWorkerRetryBackoff, WorkerBackoff(1))
+	assert.Equal(t, 2*ConfigWorkerRetryBackoff, WorkerBackoff(2))
+	assert.Equal(t, 4*ConfigWorkerRetryBackoff, WorkerBackoff(3))
+	assert.Equal(t, ConfigWorkerRetryBackoffMax, WorkerBackoff(100))
+}
+
+func TestPinRunningSkipped(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	leased, err := LeaseAcquire(context.Background(), "pin:"+pinIn.Id, "job-other", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+	err = WorkerProcess(context.Background(), "job-1", &WorkerJob{PinId: pinIn.Id, Attempt: 1})
+	assert.Nil(t, err)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, pinIn.Version, pinOut.Version)
+	assert.Nil(t, pinOut.QueryStartedAt)
+	Must(LeaseRelease(context.Background(), "pin:"+pinIn.Id, "job-other"))
+	err = WorkerProcess(context.Background(), "job-1", &WorkerJob{PinId: pinIn.Id, Attempt: 1})
+	assert.Nil(t, err)
+	pinOut = mustPinGet(pinIn.Id)
+	assert.NotNil(t, pinOut.QueryFinishedAt)
+	leased, err = LeaseAcquire(context.Background(), "pin:"+pinIn.Id, "job-other", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+}
+
+func TestPinRedeliveredJobSkipped(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select pg_sleep(0.5)")
+	job := &WorkerJob{PinId: pinIn.Id, Attempt: 1}
+	done := make(chan error)
+	go func() { done <- WorkerProcess(ctx, "job-1", job) }()
+	for {
+		leases, err := PgCount(ctx, "SELECT count(*) FROM leases WHERE name=$1", "pin:"+pinIn.Id)
+		Must(err)
+		if leases == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := WorkerProcess(ctx, "job-1", job)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, pinIn.Version+1, pinOut.Version)
+	leases, err := PgCount(ctx, "SELECT count(*) FROM leases")
+	Must(err)
+	assert.Equal(t, 0, leases)
+}
+
+func TestPinDbSaturatedDeferred(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	dbIn.MaxQueries = 1
+	Must(DbUpdate(ctx, dbIn))
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	testQueue.Clear()
+	leased, err := LeaseAcquire(ctx, "db:"+dbIn.Id+":0", "job-other", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+	job := &WorkerJob{PinId: pinIn.Id, Attempt: 1, Priority: WorkerPriorityInteractive}
+	err = WorkerProcess(ctx, "job-1", job)
+	assert.Nil(t, err)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Nil(t, pinOut.QueryStartedAt)
+	jobs := testQueue.Jobs(WorkerQueue(WorkerPriorityInteractive))
+	assert.Equal(t, 1, len(jobs))
+	deferred, err := WorkerParseJob(jobs[0].Payload)
+	Must(err)
+	assert.Equal(t, 1, deferred.Attempt)
+	Must(LeaseRelease(ctx, "db:"+dbIn.Id+":0", "job-other"))
+	err = WorkerProcess(ctx, "job-2", deferred)
+	assert.Nil(t, err)
+	pinOut = mustPinGet(pinIn.Id)
+	assert.NotNil(t, pinOut.QueryFinishedAt)
+	leased, err = LeaseAcquire(ctx, "db:"+dbIn.Id+":0", "job-other", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+}
+
+func TestLease(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	leased, err := LeaseAcquire(ctx, "lease-1", "holder-1", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-2", time.Minute)
+	Must(err)
+	assert.False(t, leased)
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-1", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+	Must(LeaseRelease(ctx, "lease-1", "holder-2"))
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-2", time.Minute)
+	Must(err)
+	assert.False(t, leased)
+	Must(LeaseRelease(ctx, "lease-1", "holder-1"))
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-2", time.Millisecond)
+	Must(err)
+	assert.True(t, leased)
+	time.Sleep(10 * time.Millisecond)
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-1", time.Minute)
+	Must(err)
+	assert.True(t, leased)
+}
+
+func TestLeaseKeep(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	ttl := 300 * time.Millisecond
+	leased, err := LeaseAcquire(ctx, "lease-1", "holder-1", ttl)
+	Must(err)
+	assert.True(t, leased)
+	keepCtx, stop := LeaseKeep(ctx, "lease-1", "holder-1", ttl)
+	time.Sleep(3 * ttl)
+	leased, err = LeaseAcquire(ctx, "lease-1", "holder-2", ttl)
+	Must(err)
+	assert.False(t, leased)
+	assert.Nil(t, keepCtx.Err())
+	stop()
+	assert.NotNil(t, keepCtx.Err())
+	keepCtx, stop = LeaseKeep(ctx, "lease-1", "holder-1", ttl)
+	defer stop()
+	_, err = PgConn.Exec("UPDATE leases SET holder='holder-2' WHERE name='lease-1'")
+	Must(err)
+	select {
+	case <-keepCtx.Done():
+	case <-time.After(3 * ttl):
+		t.Fatal("lease loss didn't cancel the context")
+	}
+}
+
 func TestPinOptomisticLocking(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
 	pinWinsRace := mustPinCreate(dbIn.Id, "pins-1", "select 1")
 	pinLosesRace := mustPinGet(pinWinsRace.Id)
 	pinWinsRace.Query = "select 'wins'"
-	err := PinUpdate(pinWinsRace)
+	err := PinUpdate(context.Background(), pinWinsRace)
 	assert.Nil(t, err)
 	pinLosesRace.Query = "select 'loses'"
-	err = PinUpdate(pinLosesRace)
+	err = PinUpdate(context.Background(), pinLosesRace)
 	assert.Equal(t, "pin-concurrent-update", err.(*PgpinError).Id)
+	assert.Equal(t, 409, err.(*PgpinError).HttpStatus)
 	pinAfterRace := mustPinGet(pinWinsRace.Id)
 	assert.Equal(t, "select 'wins'", pinAfterRace.Query)
 }
 
+func TestPinUpdateIfMatch(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id, nil)
+	etag := res.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+	res = mustRequestHeader("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1a"}`), http.Header{"If-Match": {etag}})
+	assert.Equal(t, 200, res.Code)
+	etagUpdated := res.Header().Get("ETag")
+	assert.NotEqual(t, etag, etagUpdated)
+	res = mustRequestHeader("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1b"}`), http.Header{"If-Match": {etag}})
+	assert.Equal(t, 412, res.Code)
+	data := map[string]string{}
+	mustDecode(res, &data)
+	assert.Equal(t, "precondition-failed", data["id"])
+	res = mustRequestHeader("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1b"}`), http.Header{"If-Match": {"W/" + etagUpdated}})
+	assert.Equal(t, 412, res.Code)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, "pins-1a", pinOut.Name)
+	res = mustRequestHeader("PATCH", "/v1/pins/"+pinIn.Id, asReader(`{"name": "pins-1b"}`), http.Header{"If-Match": {etagUpdated}})
+	assert.Equal(t, 200, res.Code)
+}
+
+func TestDbUpdateIfMatch(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", "postgres://u:p@h:1234/d-1")
+	res := mustRequest("GET", "/v1/dbs/"+dbIn.Id, nil)
+	etag := res.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+	res = mustRequestHeader("PATCH", "/v1/dbs/"+dbIn.Id, asReader(`{"name": "dbs-1a"}`), http.Header{"If-Match": {etag}})
+	assert.Equal(t, 200, res.Code)
+	assert.NotEqual(t, etag, res.Header().Get("ETag"))
+	res = mustRequestHeader("PATCH", "/v1/dbs/"+dbIn.Id, asReader(`{"name": "dbs-1b"}`), http.Header{"If-Match": {etag}})
+	assert.Equal(t, 412, res.Code)
+	dbOut, err := DbGet(context.Background(), dbIn.Id)
+	Must(err)
+	assert.Equal(t, "dbs-1a", dbOut.Name)
+}
+
 func TestPinDelete(t *testing.T) {
 	defer clear()
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
@@ -350,7 +984,7 @@ func TestPinList(t *testing.T) {
 	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
 	pinIn1 := mustPinCreate(dbIn.Id, "pins-1", "select count(*) from pins")
 	pinIn2 := mustPinCreate(dbIn.Id, "pins-2", "select * from pins")
-	_, err := PinDelete(pinIn1.Id)
+	_, err := PinDelete(context.Background(), pinIn1.Id)
 	Must(err)
 	res := mustRequest("GET", "/v1/pins", nil)
 	assert.Equal(t, 200, res.Code)
@@ -361,14 +995,352 @@ func TestPinList(t *testing.T) {
 	assert.Equal(t, "pins-2", pinsOut[0].Name)
 }
 
+func TestPinListOmitsResults(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	mustWorkerTick()
+	res := mustRequest("GET", "/v1/pins", nil)
+	assert.Equal(t, 200, res.Code)
+	pinsOut := []map[string]interface{}{}
+	mustDecode(res, &pinsOut)
+	assert.Equal(t, 1, len(pinsOut))
+	_, ok := pinsOut[0]["results_rows"]
+	assert.False(t, ok)
+	_, ok = pinsOut[0]["results_sets"]
+	assert.False(t, ok)
+	assert.Equal(t, []interface{}{"?column?"}, pinsOut[0]["results_fields"])
+}
+
+func TestPinResultsStoredAsBlobs(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	mustWorkerTick()
+	pinOut1 := mustPinGet(pinIn.Id)
+	Must(WorkerEnqueue(context.Background(), pinIn.Id, WorkerPriorityInteractive))
+	mustWorkerTick()
+	pinOut2 := mustPinGet(pinIn.Id)
+	assert.NotEqual(t, *pinOut1.ResultsKey, *pinOut2.ResultsKey)
+	assert.Equal(t, `[[1]]`, mustCanonicalizeJson(pinOut2.ResultsRows))
+	blobs, err := PgCount(context.Background(), "SELECT count(*) FROM blobs WHERE key=$1", *pinOut2.ResultsKey)
+	Must(err)
+	assert.Equal(t, 1, blobs)
+	blobs, err = PgCount(context.Background(), "SELECT count(*) FROM blobs")
+	Must(err)
+	assert.Equal(t, 1, blobs)
+}
+
+func TestPinResultsRefreshedSinceRead(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	mustWorkerTick()
+	pin, err := PinGet(ctx, pinIn.Id)
+	Must(err)
+	_, err = PgConn.ExecContext(ctx, "UPDATE pins SET query='select 2' WHERE id=$1", pinIn.Id)
+	Must(err)
+	Must(WorkerEnqueue(ctx, pinIn.Id, WorkerPriorityInteractive))
+	mustWorkerTick()
+	Must(PinLoadResults(ctx, pin))
+	assert.Equal(t, `[[2]]`, mustCanonicalizeJson(pin.ResultsRows))
+	current := mustPinGet(pinIn.Id)
+	assert.Equal(t, current.Version, pin.Version)
+	blob, err := PinOpenResults(ctx, pin)
+	Must(err)
+	Must(blob.Close())
+}
+
+func TestPinResultsLegacy(t *testing.T) {
+	defer clear()
+	ctx := context.Background()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1 as a")
+	_, err := PgConn.ExecContext(ctx, `UPDATE pins SET results_fields='["a"]', results_rows='[[12345678901234567890]]', query_finished_at=now() WHERE id=$1`, pinIn.Id)
+	Must(err)
+	pinOut := mustPinGet(pinIn.Id)
+	assert.Equal(t, `[[12345678901234567890]]`, string(pinOut.ResultsRows))
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=csv", nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "a\n12345678901234567890\n", res.Body.String())
+	_, err = PgConn.ExecContext(ctx, `UPDATE pins SET results_sets='[{"fields":["b"],"rows":[[2]]}]' WHERE id=$1`, pinIn.Id)
+	Must(err)
+	pinOut = mustPinGet(pinIn.Id)
+	assert.Equal(t, `[[2]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+	Must(WorkerEnqueue(ctx, pinIn.Id, WorkerPriorityInteractive))
+	mustWorkerTick()
+	legacy, err := PgCount(ctx, "SELECT count(*) FROM pins WHERE results_rows IS NOT NULL OR results_sets IS NOT NULL")
+	Must(err)
+	assert.Equal(t, 0, legacy)
+	pinOut = mustPinGet(pinIn.Id)
+	assert.Equal(t, `[[1]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+}
+
+func TestPinResultsDeletedOnFailedUpdate(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	pin := mustPinGet(pinIn.Id)
+	pin.Results = []*PinResultsSet{{Fields: []string{"a"}, Rows: [][]interface{}{{1}}}}
+	pin.ResultsFields = PgJson("{")
+	err := PinUpdate(context.Background(), pin)
+	assert.NotNil(t, err)
+	assert.Nil(t, pin.ResultsKey)
+	blobs, err := PgCount(context.Background(), "SELECT count(*) FROM blobs")
+	Must(err)
+	assert.Equal(t, 0, blobs)
+}
+
+func TestPinResultsDownload(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1 as a, 'x,y' as b; select wat; select null as c")
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results", nil)
+	assert.Equal(t, 404, res.Code)
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results", nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, pinOut.QueryFinishedAt.UTC().Format(http.TimeFormat), res.Header().Get("Last-Modified"))
+	assert.Equal(t, WebResultsEtag(pinOut, "json"), res.Header().Get("ETag"))
+	assert.Equal(t, mustCanonicalizeJson(pinOut.ResultsSets), mustCanonicalizeJson(res.Body.Bytes()))
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=csv&set=0", nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal(t, "a,b\n1,\"x,y\"\n", res.Body.String())
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id+"/results", nil, http.Header{"Accept": {"text/csv"}})
+	assert.Equal(t, "c\n\n", res.Body.String())
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=csv&set=1", nil)
+	assert.Equal(t, 422, res.Code)
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=csv&set=3", nil)
+	assert.Equal(t, 404, res.Code)
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=xml", nil)
+	assert.Equal(t, 400, res.Code)
+}
+
+func TestPinResultsDownloadGzip(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1 as a")
+	mustWorkerTick()
+	for _, format := range []string{"json", "ndjson"} {
+		res := mustRequestHeader("GET", "/v1/pins/"+pinIn.Id+"/results?format="+format, nil, http.Header{"Accept-Encoding": {"gzip"}})
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+		gz, err := gzip.NewReader(res.Body)
+		Must(err)
+		body, err := ioutil.ReadAll(gz)
+		Must(err)
+		res = mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format="+format, nil)
+		assert.Equal(t, "", res.Header().Get("Content-Encoding"))
+		assert.Equal(t, res.Body.String(), string(body))
+	}
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results?format=ndjson", nil)
+	lines := strings.Split(res.Body.String(), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], `{"fields":["a"],`))
+	assert.Equal(t, "[1]", lines[1])
+}
+
+func TestPinGetConditional(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1 as a")
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id, nil)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "no-cache", res.Header().Get("Cache-Control"))
+	assert.Equal(t, "", res.Header().Get("Last-Modified"))
+	mustWorkerTick()
+	res = mustRequest("GET", "/v1/pins/"+pinIn.Id, nil)
+	assert.Equal(t, 200, res.Code)
+	etag := res.Header().Get("ETag")
+	lastModified := res.Header().Get("Last-Modified")
+	assert.NotEqual(t, "", etag)
+	assert.NotEqual(t, "", lastModified)
+	assert.True(t, strings.HasPrefix(res.Header().Get("Cache-Control"), "max-age="))
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id, nil, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 304, res.Code)
+	assert.Equal(t, "", res.Body.String())
+	assert.Equal(t, etag, res.Header().Get("ETag"))
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id, nil, http.Header{"If-Modified-Since": {lastModified}})
+	assert.Equal(t, 304, res.Code)
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id, nil, http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}})
+	assert.Equal(t, 200, res.Code)
+	b := asReader(`{"name": "pins-1a"}`)
+	res = mustRequest("PATCH", "/v1/pins/"+pinIn.Id, b)
+	assert.Equal(t, 200, res.Code)
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id, nil, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 200, res.Code)
+	assert.NotEqual(t, etag, res.Header().Get("ETag"))
+}
+
+func TestPinResultsConditional(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1 as a")
+	mustWorkerTick()
+	res := mustRequest("GET", "/v1/pins/"+pinIn.Id+"/results", nil)
+	assert.Equal(t, 200, res.Code)
+	etag := res.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(res.Header().Get("Cache-Control"), "max-age="))
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id+"/results", nil, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 304, res.Code)
+	assert.Equal(t, "", res.Body.String())
+	res = mustRequestHeader("GET", "/v1/pins/"+pinIn.Id+"/results?format=csv", nil, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 200, res.Code)
+}
+
+// Job endpoints.
+
+func TestDeadJobListAndReplay(t *testing.T) {
+	defer clear()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	_, err := PgConn.Exec("UPDATE dbs SET deleted_at=now() WHERE id=$1", dbIn.Id)
+	Must(err)
+	mustWorkerTick()
+	res := mustRequest("GET", "/v1/jobs/dead", nil)
+	assert.Equal(t, 200, res.Code)
+	deadJobs := []*DeadJob{}
+	mustDecode(res, &deadJobs)
+	assert.Equal(t, 1, len(deadJobs))
+	assert.Equal(t, pinIn.Id, deadJobs[0].PinId)
+	assert.Equal(t, 1, deadJobs[0].Attempts)
+	assert.Equal(t, "pgpin: db-not-found: db not found", deadJobs[0].Error)
+	assert.Nil(t, deadJobs[0].ReplayedAt)
+	_, err = PgConn.Exec("UPDATE dbs SET deleted_at=NULL WHERE id=$1", dbIn.Id)
+	Must(err)
+	res = mustRequest("POST", "/v1/jobs/dead/"+deadJobs[0].Id+"/replay", nil)
+	assert.Equal(t, 200, res.Code)
+	deadJob := &DeadJob{}
+	mustDecode(res, deadJob)
+	assert.NotNil(t, deadJob.ReplayedAt)
+	mustWorkerTick()
+	pinOut := mustPinGet(pinIn.Id)
+	assert.NotNil(t, pinOut.QueryFinishedAt)
+	assert.Equal(t, `[[1]]`, mustCanonicalizeJson(pinOut.ResultsRows))
+}
+
+// panickingBlobStore is a blob store that panics when storing.
+type panickingBlobStore struct {
+	BlobStore
+}
+
+func (s *panickingBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	panic("blob store unavailable")
+}
+
+func TestDeadJobPanic(t *testing.T) {
+	defer clear()
+	BlobBackendPrev := BlobBackend
+	defer func() { BlobBackend = BlobBackendPrev }()
+	BlobBackend = &panickingBlobStore{BlobBackendPrev}
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	pinIn := mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	mustWorkerTick()
+	deadJobs, err := DeadJobList(context.Background())
+	Must(err)
+	assert.Equal(t, 1, len(deadJobs))
+	assert.Equal(t, pinIn.Id, deadJobs[0].PinId)
+	assert.Equal(t, 1, deadJobs[0].Attempts)
+	assert.Equal(t, "blob store unavailable", deadJobs[0].Error)
+	assert.NotNil(t, deadJobs[0].Stack)
+	assert.Contains(t, *deadJobs[0].Stack, "panickingBlobStore")
+	leases, err := PgCount(context.Background(), "SELECT count(*) FROM leases")
+	Must(err)
+	assert.Equal(t, 0, leases)
+}
+
+func TestDeadJobUnparsable(t *testing.T) {
+	defer clear()
+	WorkerProcessWrapper(context.Background(), &QueueJob{Id: "job-1", Queue: "pins.interactive", Payload: []byte(`{"pin_id":`)})
+	deadJobs, err := DeadJobList(context.Background())
+	Must(err)
+	assert.Equal(t, 0, len(deadJobs))
+}
+
+func TestDeadJobReplayNotFound(t *testing.T) {
+	res := mustRequest("POST", "/v1/jobs/dead/"+uuid.New()+"/replay", nil)
+	assert.Equal(t, 404, res.Code)
+	data := make(map[string]string)
+	mustDecode(res, &data)
+	assert.Equal(t, "dead-job-not-found", data["id"])
+}
+
+// Worker endpoints.
+
+func TestWorkerList(t *testing.T) {
+	defer clear()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Must(HeartbeatStart(ctx))
+	HeartbeatJobStart("job-1", "pin-1", "request-1")
+	defer HeartbeatJobFinish("job-1")
+	Must(HeartbeatBeat(ctx))
+	_, err := PgConn.Exec("INSERT INTO workers (id, hostname, pid, started_at, heartbeat_at, jobs) VALUES ($1, 'stale', 1, $2, $2, '[]')",
+		uuid.New(), time.Now().Add(-ConfigWorkerHeartbeatTtl-time.Second))
+	Must(err)
+	res := mustRequest("GET", "/v1/workers", nil)
+	assert.Equal(t, 200, res.Code)
+	heartbeats := []*Heartbeat{}
+	mustDecode(res, &heartbeats)
+	assert.Equal(t, 1, len(heartbeats))
+	assert.Equal(t, os.Getpid(), heartbeats[0].Pid)
+	assert.Equal(t, 1, len(heartbeats[0].Jobs))
+	assert.Equal(t, "pin-1", heartbeats[0].Jobs[0].PinId)
+	assert.Equal(t, "request-1", heartbeats[0].Jobs[0].RequestId)
+}
+
 // Misc endpoints.
 
 func TestStatus(t *testing.T) {
+	mustSchedulerTick()
 	res := mustRequest("GET", "/status", nil)
 	assert.Equal(t, 200, res.Code)
 	status := &Status{}
 	mustDecode(res, status)
 	assert.Equal(t, "ok", status.Message)
+	for _, name := range []string{"postgres", "queue", "scheduler", "pins"} {
+		assert.Equal(t, "ok", status.Checks[name].Status)
+	}
+	assert.Equal(t, 0.0, *status.Checks["queue"].Value)
+}
+
+func TestStatusDegradedQueue(t *testing.T) {
+	defer clear()
+	mustSchedulerTick()
+	dbIn := mustDbCreate("dbs-1", ConfigDatabaseUrl)
+	mustPinCreate(dbIn.Id, "pins-1", "select 1")
+	ConfigStatusQueueDepthMaxPrev := ConfigStatusQueueDepthMax
+	defer func() {
+		ConfigStatusQueueDepthMax = ConfigStatusQueueDepthMaxPrev
+	}()
+	ConfigStatusQueueDepthMax = 0
+	res := mustRequest("GET", "/status", nil)
+	assert.Equal(t, 503, res.Code)
+	status := &Status{}
+	mustDecode(res, status)
+	assert.Equal(t, "degraded", status.Message)
+	assert.Equal(t, "degraded", status.Checks["queue"].Status)
+	assert.Equal(t, 1.0, *status.Checks["queue"].Value)
+	assert.Equal(t, "ok", status.Checks["postgres"].Status)
+}
+
+func TestStatusDegradedScheduler(t *testing.T) {
+	mustSchedulerTick()
+	ConfigStatusSchedulerTickMaxPrev := ConfigStatusSchedulerTickMax
+	defer func() {
+		ConfigStatusSchedulerTickMax = ConfigStatusSchedulerTickMaxPrev
+	}()
+	ConfigStatusSchedulerTickMax = 0
+	res := mustRequest("GET", "/status", nil)
+	assert.Equal(t, 503, res.Code)
+	status := &Status{}
+	mustDecode(res, status)
+	assert.Equal(t, "degraded", status.Checks["scheduler"].Status)
+	assert.NotEmpty(t, status.Checks["scheduler"].Message)
 }
 
 func TestError(t *testing.T) {
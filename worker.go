@@ -1,75 +1,555 @@
 package main
 
 import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/jrallison/go-workers"
 	"github.com/lib/pq"
 	"log"
+	"math"
+	"net"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"strings"
 	"time"
 )
 
-func WorkerExtractPgerror(err error) (*string, error) {
-	pgerr, ok := err.(pq.PGError)
-	if ok {
-		msg := pgerr.Get('M')
-		return &msg, nil
+// Pin runs are enqueued at one of two priorities. Interactive runs
+// are those a user is waiting on, such as for a newly created pin,
+// and are taken by workers ahead of scheduled refreshes.
+const (
+	WorkerPriorityInteractive = "interactive"
+	WorkerPriorityScheduled   = "scheduled"
+)
+
+// WorkerQueues lists the pin job queues in the order workers drain
+// them. The "pins" queue holds jobs enqueued before priorities were
+// introduced.
+var WorkerQueues = []string{
+	WorkerQueue(WorkerPriorityInteractive),
+	WorkerQueue(WorkerPriorityScheduled),
+	"pins",
+}
+
+// WorkerQueue returns the queue for pin jobs of the given priority.
+func WorkerQueue(priority string) string {
+	return "pins." + priority
+}
+
+// WorkerJob is the payload of pin jobs. The request id is that of
+// the web request or scheduler tick that enqueued the job, and is
+// carried through to the job's logs. Attempt counts from 1, and is
+// incremented as the job is retried.
+type WorkerJob struct {
+	PinId     string `json:"pin_id"`
+	RequestId string `json:"request_id"`
+	Attempt   int    `json:"attempt"`
+	Priority  string `json:"priority"`
+}
+
+// WorkerEnqueue enqueues a run of the pin with the given id at the
+// given priority, recording the request id from ctx in the job
+// payload.
+func WorkerEnqueue(ctx context.Context, pinId string, priority string) error {
+	job := &WorkerJob{
+		PinId:     pinId,
+		RequestId: ContextRequestId(ctx),
+		Attempt:   1,
+		Priority:  priority,
+	}
+	return QueueBackend.Enqueue(ctx, WorkerQueue(priority), job, time.Now())
+}
+
+// WorkerBackoff returns how long to wait before retrying a job
+// whose given attempt failed. The delay starts at
+// ConfigWorkerRetryBackoff and doubles with each attempt, up to
+// ConfigWorkerRetryBackoffMax.
+func WorkerBackoff(attempt int) time.Duration {
+	delay := ConfigWorkerRetryBackoff
+	for i := 1; i < attempt && delay < ConfigWorkerRetryBackoffMax; i++ {
+		delay = delay * 2
+	}
+	if delay > ConfigWorkerRetryBackoffMax {
+		delay = ConfigWorkerRetryBackoffMax
+	}
+	return delay
+}
+
+// WorkerEnqueueRetry enqueues the next attempt of job, to run
+// after the backoff for its current attempt.
+func WorkerEnqueueRetry(ctx context.Context, job *WorkerJob) (time.Duration, error) {
+	delay := WorkerBackoff(job.Attempt)
+	retry := &WorkerJob{
+		PinId:     job.PinId,
+		RequestId: job.RequestId,
+		Attempt:   job.Attempt + 1,
+		Priority:  job.Priority,
+	}
+	return delay, QueueBackend.Enqueue(ctx, WorkerQueue(job.Priority), retry, time.Now().Add(delay))
+}
+
+// WorkerParseJob extracts the WorkerJob from the given queue job
+// payload. Jobs enqueued before request ids were recorded have a
+// bare pin id as their payload, and are handled as well. Jobs
+// without a priority are treated as scheduled.
+func WorkerParseJob(payload []byte) (*WorkerJob, error) {
+	var pinId string
+	err := json.Unmarshal(payload, &pinId)
+	if err == nil {
+		return &WorkerJob{PinId: pinId, Attempt: 1, Priority: WorkerPriorityScheduled}, nil
+	}
+	job := &WorkerJob{}
+	err = json.Unmarshal(payload, job)
+	if err != nil {
+		return nil, err
+	}
+	if job.Attempt == 0 {
+		job.Attempt = 1
+	}
+	if job.Priority == "" {
+		job.Priority = WorkerPriorityScheduled
 	}
-	if err.Error() == "driver: bad connection" {
-		msg := "could not connect to database"
+	return job, nil
+}
+
+// WorkerRetryable returns true if err is likely transient, such
+// as a refused or dropped connection, a lock timeout, or the pin db
+// shutting down, in which case the run should be retried.
+func WorkerRetryable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pgerr *pq.Error
+	if errors.As(err, &pgerr) {
+		switch pgerr.Code.Class() {
+		case "08", "53":
+			return true
+		}
+		switch pgerr.Code {
+		case "40001", "40P01", "55P03", "57P01", "57P02", "57P03":
+			return true
+		}
+	}
+	return false
+}
+
+// WorkerConnectFailed returns true if pgerr reports a failure to
+// connect to the pin db: a connection exception, a missing
+// database, or a rejected password. lib/pq returns these as errors
+// from the server at startup, whose messages are not shown to users.
+func WorkerConnectFailed(pgerr *pq.Error) bool {
+	return pgerr.Code.Class() == "08" || pgerr.Code.Class() == "3D" || pgerr.Code == "28P01"
+}
+
+// WorkerErrorMessage returns the user-facing message recorded for a
+// pin whose run failed with the given error.
+func WorkerErrorMessage(err error) string {
+	var pgerr *pq.Error
+	if errors.As(err, &pgerr) && !WorkerConnectFailed(pgerr) {
+		return pgerr.Message
+	}
+	if WorkerRetryable(err) || pgerr != nil {
+		return "could not connect to database"
+	}
+	return err.Error()
+}
+
+// WorkerExtractPgerror splits err into a user-facing message for
+// errors caused by the pin query or pin db, and a system error
+// otherwise. Errors arising because ctx was cancelled are always
+// system errors, so that an interrupted run isn't recorded as a
+// failure of the pin, as are retryable errors.
+func WorkerExtractPgerror(ctx context.Context, err error) (*string, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if WorkerRetryable(err) {
+		return nil, err
+	}
+	var pgerr *pq.Error
+	if errors.As(err, &pgerr) {
+		msg := WorkerErrorMessage(pgerr)
 		return &msg, nil
 	}
 	return nil, err
 }
 
-// WorkerCoerceType returns a coerced version of the raw
-// database value in, which we get from scanning into
-// interface{}s. We expect queries from the following
-// Postgres types to result in the following return values:
-// [Postgres] -> [Go: in] -> [Go: WorkerCoerceType'd]
-// text          []byte      string
-// ???
-func WorkerCoerceType(in interface{}) interface{} {
+// WorkerCoerceType returns a version of the raw database value in,
+// which we get from scanning into interface{}s, suitable for
+// encoding as JSON in pin results. The coercion is driven by
+// typeName, the Postgres type name of the result column as
+// reported by lib/pq, as follows:
+//
+//	[Postgres]                  -> [JSON]
+//	int2, int4, int8, oid          number
+//	numeric                        number, exactly as output by Postgres,
+//	                               or string for NaN
+//	float4, float8                 number, or string for NaN and
+//	                               [-]Infinity
+//	bool                           boolean
+//	text, varchar, char, name      string
+//	json, jsonb                    embedded JSON
+//	bytea                          string, base64 encoded
+//	timestamptz                    string, RFC 3339
+//	timestamp                      string, RFC 3339 without offset
+//	date                           string, YYYY-MM-DD
+//	time, timetz                   string, HH:MM:SS[.ffffff][+HH:MM]
+//	interval                       string, ISO 8601 duration
+//	uuid, inet, cidr, macaddr      string
+//	arrays of the above            array, with elements coerced
+//	                               as above
+//	other                          string, as output by Postgres
+//	null                           null
+//
+// Infinite timestamps and dates are returned as the strings
+// "infinity" and "-infinity". Intervals are ISO 8601 because pin db
+// connections set intervalstyle accordingly.
+func WorkerCoerceType(typeName string, in interface{}) interface{} {
 	switch in := in.(type) {
+	case nil:
+		return nil
+	case float64:
+		return workerCoerceFloat(in)
+	case time.Time:
+		return workerCoerceTime(typeName, in)
 	case []byte:
-		return string(in)
+		if typeName == "BYTEA" {
+			return base64.StdEncoding.EncodeToString(in)
+		}
+		return workerCoerceText(typeName, string(in))
 	default:
 		return in
 	}
 }
 
-// WorkerQuery queries the pin db at pinDbUrl and updates the
-// passed pin according to the results/errors. System errors
-// are returned.
-func WorkerQuery(p *Pin, pinDbUrl string) error {
-	log.Printf("worker.query.start pin_id=%s", p.Id)
-	applicationName := fmt.Sprintf("pgpin.pin.%s", p.Id)
-	pinDbConn := fmt.Sprintf("%s?application_name=%s&statement_timeout=%d&connect_timeout=%d",
-		pinDbUrl, applicationName, ConfigPinStatementTimeout/time.Millisecond, ConfigDatabaseConnectTimeout/time.Millisecond)
-	pinDb, err := sql.Open("postgres", pinDbConn)
+var workerNumberRegexp = regexp.MustCompile(`\A-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?\z`)
+
+// workerCoerceText coerces the Postgres text output s of a value of
+// the given type, as for raw values lib/pq doesn't itself decode
+// and for the elements of arrays.
+func workerCoerceText(typeName string, s string) interface{} {
+	if strings.HasPrefix(typeName, "_") {
+		elems, err := PgArrayParse(s)
+		if err != nil {
+			return s
+		}
+		return workerCoerceArray(typeName[1:], elems)
+	}
+	switch typeName {
+	case "INT2", "INT4", "INT8", "OID", "NUMERIC", "FLOAT4", "FLOAT8":
+		if workerNumberRegexp.MatchString(s) {
+			return json.Number(s)
+		}
+		return s
+	case "BOOL":
+		return s == "t"
+	case "JSON", "JSONB":
+		return json.RawMessage(s)
+	case "BYTEA":
+		b, err := hex.DecodeString(strings.TrimPrefix(s, "\\x"))
+		if err != nil {
+			return s
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	case "TIMESTAMPTZ", "TIMESTAMP", "DATE", "TIME", "TIMETZ":
+		t, err := pq.ParseTimestamp(nil, s)
+		if err != nil {
+			return s
+		}
+		return workerCoerceTime(typeName, t)
+	default:
+		return s
+	}
+}
+
+func workerCoerceArray(elemTypeName string, elems []interface{}) []interface{} {
+	out := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		switch elem := elem.(type) {
+		case string:
+			out[i] = workerCoerceText(elemTypeName, elem)
+		case []interface{}:
+			out[i] = workerCoerceArray(elemTypeName, elem)
+		}
+	}
+	return out
+}
+
+func workerCoerceFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	default:
+		return f
+	}
+}
+
+func workerCoerceTime(typeName string, t time.Time) string {
+	switch typeName {
+	case "TIMESTAMP":
+		return t.Format("2006-01-02T15:04:05.999999999")
+	case "DATE":
+		return t.Format("2006-01-02")
+	case "TIME":
+		return t.Format("15:04:05.999999999")
+	case "TIMETZ":
+		return t.Format("15:04:05.999999999Z07:00")
+	default:
+		return t.Format(time.RFC3339Nano)
+	}
+}
+
+// WorkerResultsColumns describes the columns of pin results with
+// the given types. Type names are as reported by lib/pq, lowercased
+// to match Postgres's, and are empty for types not built in to
+// Postgres; see WorkerResultsDescribe.
+func WorkerResultsColumns(types []*sql.ColumnType) []*PinResultsColumn {
+	columns := make([]*PinResultsColumn, len(types))
+	for i, columnType := range types {
+		column := &PinResultsColumn{
+			Name: columnType.Name(),
+			Type: strings.ToLower(columnType.DatabaseTypeName()),
+		}
+		if length, ok := columnType.Length(); ok && length >= 0 && length != math.MaxInt64 {
+			column.Length = &length
+		}
+		// Numerics without a declared precision report nonsense.
+		if precision, scale, ok := columnType.DecimalSize(); ok && precision <= 1000 {
+			column.Precision = &precision
+			column.Scale = &scale
+		}
+		columns[i] = column
+	}
+	return columns
+}
+
+// WorkerResultsDescribe fills in the type OIDs and nullability of
+// the columns of statement's results from the row description
+// Postgres gives for it on conn, looking up nullability, and the
+// type names lib/pq doesn't know, such as of user-defined and
+// extension types, in tx. Only columns read directly from table
+// columns have a known nullability, which is as declared on the
+// table: outer joins can still make such columns null.
+func WorkerResultsDescribe(ctx context.Context, conn *sql.Conn, tx *sql.Tx, statement string, columns []*PinResultsColumn) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	var descriptions []pq.ColumnDescription
+	err := conn.Raw(func(driverConn interface{}) error {
+		var err error
+		descriptions, err = pq.DescribeColumns(driverConn, statement)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(descriptions) != len(columns) {
+		return fmt.Errorf("worker: statement described with %d columns, not %d", len(descriptions), len(columns))
+	}
+	for i, column := range columns {
+		description := descriptions[i]
+		typeOid := uint32(description.TypeOID)
+		column.Oid = &typeOid
+		if description.TableOID != 0 {
+			var nullable bool
+			err := tx.QueryRowContext(ctx, "SELECT NOT attnotnull FROM pg_attribute WHERE attrelid=$1 AND attnum=$2",
+				uint32(description.TableOID), description.TableAttr).Scan(&nullable)
+			if err != nil {
+				return err
+			}
+			column.Nullable = &nullable
+		}
+		if column.Type == "" {
+			err := tx.QueryRowContext(ctx, "SELECT format_type($1, NULL)", typeOid).Scan(&column.Type)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// workerApplicationNameMax is the length Postgres truncates
+// application names to.
+const workerApplicationNameMax = 63
+
+// WorkerApplicationName returns the application_name used when
+// querying the pin db, so that pin queries can be traced back to
+// the pin and originating request from the pin db side. Request
+// ids come from clients, so any characters in them other than
+// printable ASCII are replaced with '?', as Postgres would. Names
+// with a request id give only the first 8 characters of the pin id,
+// and overlong request ids are cut short, so that the name fits in
+// workerApplicationNameMax bytes.
+func WorkerApplicationName(pinId string, requestId string) string {
+	if requestId == "" {
+		return fmt.Sprintf("pgpin.pin.%s", pinId)
+	}
+	requestId = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, requestId)
+	if len(pinId) > 8 {
+		pinId = pinId[:8]
+	}
+	requestIdMax := workerApplicationNameMax - len("pgpin..") - len(pinId)
+	if len(requestId) > requestIdMax {
+		requestId = requestId[:requestIdMax]
+	}
+	return fmt.Sprintf("pgpin.%s.%s", requestId, pinId)
+}
+
+// WorkerQuery queries the pin db and updates the passed pin
+// according to the results/errors. System errors are returned.
+// The query runs on a connection from the db's pool, with the
+// connection's application_name set for the run.
+//
+// The query may consist of several statements, which are run in
+// order in a single transaction, so that earlier statements like SET
+// search_path or CREATE TEMPORARY TABLE apply to later ones. As when
+// pins ran a single statement, what the statements may do is limited
+// only by the privileges of the pin db's role, and the transaction
+// is committed once all have run. Each statement runs under a
+// savepoint, so that a failing statement doesn't prevent the
+// following ones from running, and its effects are rolled back.
+// Results are recorded per statement in the pin's Results, to be
+// stored by PinUpdate. ResultsFields, ResultsColumns,
+// ResultsTruncated and ResultsRowCount mirror the last result set,
+// and ResultsError the first failing statement's error. Result rows
+// are truncated once the run's rows exceed ConfigPinResultsBytesMax
+// bytes as JSON. The connection's session state is discarded before
+// it's returned to the pool.
+func WorkerQuery(ctx context.Context, p *Pin, db *Db) error {
+	requestId := ContextRequestId(ctx)
+	log.Printf("worker.query.start request_id=%s pin_id=%s", requestId, p.Id)
+	pool, err := DbPoolGet(db)
+	if err != nil {
+		p.ResultsError, err = WorkerExtractPgerror(ctx, err)
+		return err
+	}
+	pinDbConn, err := pool.Conn(ctx)
+	if err != nil {
+		p.ResultsError, err = WorkerExtractPgerror(ctx, err)
+		return err
+	}
+	defer func() {
+		_, err := pinDbConn.ExecContext(context.Background(), "DISCARD ALL")
+		if err != nil {
+			log.Printf("worker.query.error request_id=%s pin_id=%s discard %s", requestId, p.Id, err)
+		}
+		Must(pinDbConn.Close())
+	}()
+	_, err = pinDbConn.ExecContext(ctx, "SELECT set_config('application_name', $1, false)", WorkerApplicationName(p.Id, requestId))
 	if err != nil {
-		p.ResultsError, err = WorkerExtractPgerror(err)
+		p.ResultsError, err = WorkerExtractPgerror(ctx, err)
 		return err
 	}
-	resultsRows, err := pinDb.Query(p.Query)
+	statements := PgSplitStatements(p.Query)
+	if len(statements) == 0 {
+		message := "query has no statements"
+		p.ResultsError = &message
+		return nil
+	}
+	tx, err := pinDbConn.BeginTx(ctx, nil)
 	if err != nil {
-		p.ResultsError, err = WorkerExtractPgerror(err)
+		p.ResultsError, err = WorkerExtractPgerror(ctx, err)
 		return err
 	}
+	defer func() { _ = tx.Rollback() }()
+	resultsSets := make([]*PinResultsSet, 0, len(statements))
+	resultsBytesLeft := ConfigPinResultsBytesMax
+	var resultsError *string
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, "SAVEPOINT pgpin_statement")
+		if err != nil {
+			p.ResultsError, err = WorkerExtractPgerror(ctx, err)
+			return err
+		}
+		resultsSet, err := WorkerQueryStatement(ctx, pinDbConn, tx, statement, p.MaxRows, &resultsBytesLeft)
+		if err != nil {
+			return err
+		}
+		if resultsSet.Error != nil {
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT pgpin_statement")
+			if err != nil {
+				p.ResultsError, err = WorkerExtractPgerror(ctx, err)
+				return err
+			}
+			if resultsError == nil {
+				resultsError = resultsSet.Error
+			}
+		}
+		resultsSets = append(resultsSets, resultsSet)
+	}
+	err = tx.Commit()
+	if err != nil {
+		p.ResultsError, err = WorkerExtractPgerror(ctx, err)
+		return err
+	}
+	last := resultsSets[len(resultsSets)-1]
+	p.ResultsFields = MustNewPgJson(last.Fields)
+	p.ResultsColumns = MustNewPgJson(last.Columns)
+	p.ResultsTruncated = last.Truncated
+	p.ResultsRowCount = nil
+	if last.Error == nil {
+		p.ResultsRowCount = &last.RowCount
+	}
+	p.ResultsError = resultsError
+	p.Results = resultsSets
+	log.Printf("worker.query.finish request_id=%s pin_id=%s statements=%d", requestId, p.Id, len(statements))
+	return nil
+}
+
+// WorkerQueryStatement runs a single statement of a pin's query in
+// tx, on conn, and returns its results, truncated to maxRows rows.
+// Rows are also truncated once their JSON encoding would exceed
+// *bytesLeft, which is decremented as rows are scanned, so that the
+// byte budget is shared by all statements of a run. Errors caused by
+// the statement are recorded in the returned set; system errors are
+// returned.
+func WorkerQueryStatement(ctx context.Context, conn *sql.Conn, tx *sql.Tx, statement string, maxRows int, bytesLeft *int) (*PinResultsSet, error) {
+	resultsSet := &PinResultsSet{}
+	resultsRows, err := tx.QueryContext(ctx, statement)
+	if err != nil {
+		resultsSet.Error, err = WorkerExtractPgerror(ctx, err)
+		return resultsSet, err
+	}
 	defer func() { Must(resultsRows.Close()) }()
 	resultsFieldsData, err := resultsRows.Columns()
 	if err != nil {
-		p.ResultsError, err = WorkerExtractPgerror(err)
-		return err
+		resultsSet.Error, err = WorkerExtractPgerror(ctx, err)
+		return resultsSet, err
 	}
+	resultsTypes, err := resultsRows.ColumnTypes()
+	if err != nil {
+		resultsSet.Error, err = WorkerExtractPgerror(ctx, err)
+		return resultsSet, err
+	}
+	resultsColumns := WorkerResultsColumns(resultsTypes)
 	resultsRowsData := make([][]interface{}, 0)
 	resultsRowsSeen := 0
 	for resultsRows.Next() {
 		resultsRowsSeen += 1
-		if resultsRowsSeen > ConfigPinResultsRowsMax {
-			message := "too many rows in query results"
-			p.ResultsError = &message
-			return nil
+		if resultsRowsSeen > maxRows {
+			resultsSet.Truncated = true
+			break
 		}
 		resultsRowData := make([]interface{}, len(resultsFieldsData))
 		resultsRowPointers := make([]interface{}, len(resultsFieldsData))
@@ -78,65 +558,268 @@ func WorkerQuery(p *Pin, pinDbUrl string) error {
 		}
 		err := resultsRows.Scan(resultsRowPointers...)
 		if err != nil {
-			p.ResultsError, err = WorkerExtractPgerror(err)
-			return err
+			resultsSet.Error, err = WorkerExtractPgerror(ctx, err)
+			return resultsSet, err
 		}
 		for i, _ := range resultsRowData {
-			resultsRowData[i] = WorkerCoerceType(resultsRowData[i])
+			resultsRowData[i] = WorkerCoerceType(resultsTypes[i].DatabaseTypeName(), resultsRowData[i])
+		}
+		resultsRowJson, err := json.Marshal(resultsRowData)
+		if err != nil {
+			return resultsSet, err
 		}
+		if len(resultsRowJson) > *bytesLeft {
+			resultsSet.Truncated = true
+			break
+		}
+		*bytesLeft -= len(resultsRowJson)
 		resultsRowsData = append(resultsRowsData, resultsRowData)
 	}
 	err = resultsRows.Err()
+	if err == nil {
+		err = resultsRows.Close()
+	}
+	if err == nil {
+		err = WorkerResultsDescribe(ctx, conn, tx, statement, resultsColumns)
+	}
 	if err != nil {
-		p.ResultsError, err = WorkerExtractPgerror(err)
-		return err
+		resultsSet.Error, err = WorkerExtractPgerror(ctx, err)
+		return resultsSet, err
 	}
-	p.ResultsFields = MustNewPgJson(resultsFieldsData)
-	p.ResultsRows = MustNewPgJson(resultsRowsData)
-	log.Printf("worker.query.finish pin_id=%s", p.Id)
-	return nil
+	if resultsFieldsData == nil {
+		resultsFieldsData = []string{}
+	}
+	resultsSet.Fields = resultsFieldsData
+	resultsSet.Columns = resultsColumns
+	resultsSet.Rows = resultsRowsData
+	resultsSet.RowCount = resultsRowsSeen
+	return resultsSet, nil
 }
 
-func WorkerProcess(jobId string, pinId string) error {
-	log.Printf("worker.job.start job_id=%s pin_id=%s", jobId, pinId)
-	pin, err := PinGet(pinId)
+// WorkerProcess runs the pin for the given job and records its
+// results. Cancelling ctx, as on worker shutdown, cancels any
+// queries in flight for the run. Runs failing with retryable errors
+// are re-enqueued with backoff until ConfigWorkerRetryMax attempts
+// have been made, after which the error is recorded on the pin and
+// then the job is moved to the dead jobs store, so that a failure to
+// record it leaves the job to be dead-lettered once by WorkerFailed.
+//
+// A lease on the pin is held and renewed for the duration of the
+// run, so that the same pin is never run concurrently. Leases are
+// held under a token fresh for each run rather than the job id, as
+// queues may deliver the same job again while it's still running.
+// Jobs for pins already being run are skipped, and runs that lose
+// their lease are abandoned. One of the pin db's slots is likewise
+// held and renewed while querying, so that no more than the db's max
+// queries run against it at once. Jobs for saturated dbs are
+// deferred.
+func WorkerProcess(ctx context.Context, jobId string, job *WorkerJob) error {
+	requestId := ContextRequestId(ctx)
+	pinId := job.PinId
+	log.Printf("worker.job.start request_id=%s job_id=%s pin_id=%s priority=%s attempt=%d", requestId, jobId, pinId, job.Priority, job.Attempt)
+	leaseName := "pin:" + pinId
+	holder := uuid.New()
+	leased, err := LeaseAcquire(ctx, leaseName, holder, ConfigPinLeaseTtl)
 	if err != nil {
 		return err
 	}
-	pinDbUrl, err := PinDbUrl(pin)
+	if !leased {
+		log.Printf("worker.job.skip request_id=%s job_id=%s pin_id=%s reason=pin-running", requestId, jobId, pinId)
+		return nil
+	}
+	defer func() {
+		err := LeaseRelease(context.Background(), leaseName, holder)
+		if err != nil {
+			log.Printf("worker.lease.error request_id=%s job_id=%s pin_id=%s %s", requestId, jobId, pinId, err)
+		}
+	}()
+	jobCtx := ctx
+	ctx, stopKeep := LeaseKeep(ctx, leaseName, holder, ConfigPinLeaseTtl)
+	defer stopKeep()
+	pin, err := PinGet(ctx, pinId)
 	if err != nil {
 		return err
 	}
+	db, err := PinDb(ctx, pin)
+	if err != nil {
+		if pgerr, ok := err.(*PgpinError); ok && pgerr.Id == "db-not-found" {
+			DbPoolInvalidate(pin.DbId)
+		}
+		return err
+	}
+	slotName, err := WorkerDbSlotAcquire(ctx, db, holder)
+	if err != nil {
+		return err
+	}
+	if slotName == "" {
+		return WorkerDefer(ctx, jobId, job, db)
+	}
+	defer func() {
+		err := LeaseRelease(context.Background(), slotName, holder)
+		if err != nil {
+			log.Printf("worker.lease.error request_id=%s job_id=%s pin_id=%s %s", requestId, jobId, pinId, err)
+		}
+	}()
+	ctx, stopSlotKeep := LeaseKeep(ctx, slotName, holder, ConfigPinLeaseTtl)
+	defer stopSlotKeep()
 	startedAt := time.Now()
 	pin.QueryStartedAt = &startedAt
-	err = WorkerQuery(pin, pinDbUrl)
+	pin.QueryAttempts = job.Attempt
+	err = WorkerQuery(ctx, pin, db)
+	var exhausted error
+	if ctx.Err() != nil && jobCtx.Err() == nil {
+		log.Printf("worker.job.abandon request_id=%s job_id=%s pin_id=%s reason=lease-lost", requestId, jobId, pinId)
+		return nil
+	}
+	if err != nil && ctx.Err() == nil && WorkerRetryable(err) {
+		if job.Attempt < ConfigWorkerRetryMax {
+			return WorkerRetry(ctx, jobId, job, pin, err)
+		}
+		log.Printf("worker.job.exhausted request_id=%s job_id=%s pin_id=%s attempt=%d %s", requestId, jobId, pinId, job.Attempt, err)
+		exhausted = err
+		message := WorkerErrorMessage(err)
+		pin.ResultsError = &message
+		err = nil
+	}
 	if err != nil {
 		return err
 	}
 	finishedAt := time.Now()
 	pin.QueryFinishedAt = &finishedAt
-	err = PinUpdate(pin)
+	err = PinUpdate(ctx, pin)
+	if err != nil {
+		return err
+	}
+	if exhausted != nil {
+		WorkerDeadLetter(ctx, jobId, job, exhausted.Error(), nil)
+	}
+	log.Printf("worker.job.finish request_id=%s job_id=%s pin_id=%s priority=%s", requestId, jobId, pinId, job.Priority)
+	return nil
+}
+
+// WorkerDbSlotAcquire takes one of the db's MaxQueries slots for
+// holder, returning the name of the slot's lease, or the empty
+// string if all slots are taken.
+func WorkerDbSlotAcquire(ctx context.Context, db *Db, holder string) (string, error) {
+	for slot := 0; slot < db.MaxQueries; slot++ {
+		name := fmt.Sprintf("db:%s:%d", db.Id, slot)
+		leased, err := LeaseAcquire(ctx, name, holder, ConfigPinLeaseTtl)
+		if err != nil {
+			return "", err
+		}
+		if leased {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// WorkerDefer re-enqueues job as is, to run after
+// ConfigDbSaturatedDelay, because the pin's db is saturated. The
+// deferral doesn't count as an attempt.
+func WorkerDefer(ctx context.Context, jobId string, job *WorkerJob, db *Db) error {
+	err := QueueBackend.Enqueue(ctx, WorkerQueue(job.Priority), job, time.Now().Add(ConfigDbSaturatedDelay))
+	if err != nil {
+		return err
+	}
+	log.Printf("worker.job.defer request_id=%s job_id=%s pin_id=%s priority=%s db_id=%s reason=db-saturated delay=%s",
+		job.RequestId, jobId, job.PinId, job.Priority, db.Id, ConfigDbSaturatedDelay)
+	return nil
+}
+
+// WorkerRetry records the failed attempt on pin and enqueues the
+// next attempt of job.
+func WorkerRetry(ctx context.Context, jobId string, job *WorkerJob, pin *Pin, cause error) error {
+	err := PinUpdate(ctx, pin)
+	if err != nil {
+		return err
+	}
+	delay, err := WorkerEnqueueRetry(ctx, job)
 	if err != nil {
 		return err
 	}
-	log.Printf("worker.job.finish job_id=%s pin_id=%s", jobId, pinId)
+	log.Printf("worker.job.retry request_id=%s job_id=%s pin_id=%s priority=%s attempt=%d delay=%s %s",
+		job.RequestId, jobId, job.PinId, job.Priority, job.Attempt, delay, cause)
 	return nil
 }
 
-func WorkerProcessWrapper(msg *workers.Msg) {
-	jobId := msg.Jid()
-	pinId, err := msg.Args().String()
-	Must(err)
-	err = WorkerProcess(jobId, pinId)
+// WorkerProcessWrapper runs the queued job, handling its errors
+// and panics. Jobs whose payloads can't be parsed are reported and
+// dropped, as they could never be run or replayed.
+func WorkerProcessWrapper(ctx context.Context, queueJob *QueueJob) {
+	jobId := queueJob.Id
+	job := &WorkerJob{}
+	tags := map[string]string{"job_id": jobId}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("worker.panic request_id=%s job_id=%s pin_id=%s %s", job.RequestId, jobId, job.PinId, err)
+			stack := string(debug.Stack())
+			log.Print(stack)
+			ReportPanic("worker", err, tags)
+			WorkerDeadLetter(ctx, jobId, job, fmt.Sprint(err), &stack)
+		}
+	}()
+	job, err := WorkerParseJob(queueJob.Payload)
+	if err != nil {
+		log.Printf("worker.job.discard job_id=%s reason=unparsable %s", jobId, err)
+		ReportError("worker", err, tags)
+		return
+	}
+	tags["request_id"] = job.RequestId
+	tags["pin_id"] = job.PinId
+	HeartbeatJobStart(jobId, job.PinId, job.RequestId)
+	defer HeartbeatJobFinish(jobId)
+	ctx = ContextWithRequestId(ctx, job.RequestId)
+	err = WorkerProcess(ctx, jobId, job)
+	if err != nil {
+		log.Printf("worker.job.error request_id=%s job_id=%s pin_id=%s %s", job.RequestId, jobId, job.PinId, err)
+		WorkerFailed(ctx, jobId, job, err, tags)
+	}
+}
+
+// WorkerFailed handles a job that failed with a system error. The
+// job is retried if the error is retryable and attempts remain, and
+// is otherwise reported and moved to the dead jobs store. Jobs for
+// pins that no longer exist are dropped, and jobs interrupted by
+// shutdown are left for the queue to run again.
+func WorkerFailed(ctx context.Context, jobId string, job *WorkerJob, err error, tags map[string]string) {
+	pgerr, ok := err.(*PgpinError)
+	switch {
+	case ctx.Err() != nil:
+		return
+	case ok && pgerr.Id == "pin-not-found":
+		log.Printf("worker.job.discard request_id=%s job_id=%s pin_id=%s", job.RequestId, jobId, job.PinId)
+		return
+	case WorkerRetryable(err) && job.Attempt < ConfigWorkerRetryMax:
+		delay, retryErr := WorkerEnqueueRetry(ctx, job)
+		if retryErr == nil {
+			log.Printf("worker.job.retry request_id=%s job_id=%s pin_id=%s priority=%s attempt=%d delay=%s %s",
+				job.RequestId, jobId, job.PinId, job.Priority, job.Attempt, delay, err)
+			return
+		}
+		log.Printf("worker.job.error request_id=%s job_id=%s pin_id=%s %s", job.RequestId, jobId, job.PinId, retryErr)
+	}
+	ReportError("worker", err, tags)
+	WorkerDeadLetter(ctx, jobId, job, err.Error(), nil)
+}
+
+// WorkerDeadLetter moves the job to the dead jobs store.
+func WorkerDeadLetter(ctx context.Context, jobId string, job *WorkerJob, jobErr string, stack *string) {
+	_, err := DeadJobCreate(ctx, jobId, job, jobErr, stack)
 	if err != nil {
-		log.Printf("worker.job.error job_id=%s pin_id=%s %s", jobId, pinId, err)
+		log.Printf("worker.dead_letter.error request_id=%s job_id=%s pin_id=%s %s", job.RequestId, jobId, job.PinId, err)
 	}
 }
 
 func WorkerStart() {
 	log.Printf("worker.start")
+	ReportStart()
 	PgStart()
-	RedisStart()
-	workers.Process("pins", WorkerProcessWrapper, ConfigWorkerPoolSize)
-	workers.Run()
+	QueueStart()
+	BlobStart()
+	ctx := ContextShutdown()
+	Must(HeartbeatStart(ctx))
+	DbPoolStart(ctx)
+	QueueBackend.Run(ctx, WorkerQueues, ConfigWorkerPoolSize, WorkerProcessWrapper)
+	log.Printf("worker.exit")
 }